@@ -9,5 +9,20 @@ type Backend interface {
 	GetAll() ([]APIToken, error)
 	Add(token *APIToken) error
 	Remove(mail string) error
+	GetScheduled() ([]ScheduledNotification, error)
+	GetUserScheduled(mail string) ([]ScheduledNotification, error)
+	AddScheduled(n *ScheduledNotification) error
+	// Return false if the notification is not there anymore, so exactly one node delivers or cancels it. A
+	// notification is canceled only by its user.
+	RemoveScheduled(id string) (bool, error)
+	CancelScheduled(mail, id string) (bool, error)
+	GetCenters() ([]StoredCenter, error)
+	SaveCenter(c *StoredCenter) error
+	SaveCenterState(name, state string, expires int64) error
+	RemoveCenter(name string) error
+	// The push subscriptions of a center, JSON encoded. They are removed with the center.
+	GetPushSubscriptions(name string) ([]string, error)
+	SavePushSubscription(name, endpoint, subscription string) error
+	RemovePushSubscription(name, endpoint string) error
 	Stop()
 }
@@ -2,15 +2,24 @@ package gopush
 
 import (
 	"crypto/rsa"
+	"sync"
 )
 
 type DummyBackend struct {
-	data map[string]string
+	data      map[string]string
+	scheduled map[string]ScheduledNotification
+	centers   map[string]StoredCenter
+	// The push subscriptions by the center and the endpoint.
+	subscriptions map[string]map[string]string
+	lock          sync.Mutex
 }
 
 func NewDummyBackend() *DummyBackend {
 	return &DummyBackend{
-		data: make(map[string]string),
+		data:          make(map[string]string),
+		scheduled:     make(map[string]ScheduledNotification),
+		centers:       make(map[string]StoredCenter),
+		subscriptions: make(map[string]map[string]string),
 	}
 }
 
@@ -48,6 +57,146 @@ func (b *DummyBackend) Remove(mail string) error {
 	return nil
 }
 
+func (b *DummyBackend) GetScheduled() ([]ScheduledNotification, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var list []ScheduledNotification
+
+	for _, n := range b.scheduled {
+		list = append(list, n)
+	}
+
+	return list, nil
+}
+
+func (b *DummyBackend) GetUserScheduled(mail string) ([]ScheduledNotification, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var list []ScheduledNotification
+
+	for _, n := range b.scheduled {
+		if n.Mail == mail {
+			list = append(list, n)
+		}
+	}
+
+	return list, nil
+}
+
+func (b *DummyBackend) AddScheduled(n *ScheduledNotification) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.scheduled[n.ID] = *n
+
+	return nil
+}
+
+func (b *DummyBackend) RemoveScheduled(id string) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.scheduled[id]; !ok {
+		return false, nil
+	}
+	delete(b.scheduled, id)
+
+	return true, nil
+}
+
+func (b *DummyBackend) CancelScheduled(mail, id string) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if n, ok := b.scheduled[id]; !ok || n.Mail != mail {
+		return false, nil
+	}
+	delete(b.scheduled, id)
+
+	return true, nil
+}
+
+func (b *DummyBackend) GetCenters() ([]StoredCenter, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var list []StoredCenter
+
+	for _, c := range b.centers {
+		list = append(list, c)
+	}
+
+	return list, nil
+}
+
+func (b *DummyBackend) SaveCenter(c *StoredCenter) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.centers[c.Name] = *c
+
+	return nil
+}
+
+func (b *DummyBackend) SaveCenterState(name, state string, expires int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c, ok := b.centers[name]; ok {
+		c.State = state
+		c.StateExpires = expires
+		b.centers[name] = c
+	}
+
+	return nil
+}
+
+func (b *DummyBackend) RemoveCenter(name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.centers, name)
+	delete(b.subscriptions, name)
+
+	return nil
+}
+
+func (b *DummyBackend) GetPushSubscriptions(name string) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var list []string
+
+	for _, s := range b.subscriptions[name] {
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+func (b *DummyBackend) SavePushSubscription(name, endpoint, subscription string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.subscriptions[name]; !ok {
+		b.subscriptions[name] = make(map[string]string)
+	}
+	b.subscriptions[name][endpoint] = subscription
+
+	return nil
+}
+
+func (b *DummyBackend) RemovePushSubscription(name, endpoint string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.subscriptions[name], endpoint)
+
+	return nil
+}
+
 func (b *DummyBackend) Stop() {
 	b.data = nil
 }
@@ -2,7 +2,9 @@ package gopush
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 
 	"log"
 
@@ -16,6 +18,36 @@ const mysql_create_database = "CREATE TABLE `APIToken` ( " +
 	"PRIMARY KEY (`Mail`) " +
 	") ENGINE=InnoDB DEFAULT CHARSET=utf8;"
 
+const mysql_create_scheduled = "CREATE TABLE `ScheduledNotification` ( " +
+	"`ID` varchar(64) NOT NULL, " +
+	"`Mail` varchar(255) NOT NULL, " +
+	"`Center` varchar(255) NOT NULL, " +
+	"`Message` mediumtext NOT NULL, " +
+	"`DeliverAt` bigint NOT NULL, " +
+	"`TTL` bigint NOT NULL DEFAULT '0', " +
+	"PRIMARY KEY (`ID`), " +
+	"KEY `Mail` (`Mail`) " +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8;"
+
+const mysql_create_centers = "CREATE TABLE `NotificationCenter` ( " +
+	"`Name` varchar(255) NOT NULL, " +
+	"`Mail` varchar(255) NOT NULL, " +
+	"`Center` varchar(255) NOT NULL, " +
+	"`Options` text NOT NULL, " +
+	"`Created` bigint NOT NULL, " +
+	"`State` mediumtext NOT NULL, " +
+	"`StateExpires` bigint NOT NULL DEFAULT '0', " +
+	"PRIMARY KEY (`Name`) " +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8;"
+
+// The endpoints are too long for a key, they are identified by their SHA-256 hash.
+const mysql_create_subscriptions = "CREATE TABLE `PushSubscription` ( " +
+	"`Center` varchar(255) NOT NULL, " +
+	"`EndpointHash` char(64) NOT NULL, " +
+	"`Subscription` text NOT NULL, " +
+	"PRIMARY KEY (`Center`, `EndpointHash`) " +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8;"
+
 var userCache = make(map[string]*rsa.PublicKey)
 
 type MySQLBackend struct {
@@ -37,24 +69,30 @@ func NewMySQLBackend(config Config) *MySQLBackend {
 
 	b.connection.Exec("SET NAMES utf8;")
 
-	// Check if the table is exists. If not, create it.
-	row := b.connection.QueryRow("SELECT COUNT(*) > 0 FROM information_schema.tables WHERE table_schema = ? AND table_name = ?", config.DBName, "APIToken")
+	b.ensureTable(config.DBName, "APIToken", mysql_create_database)
+	b.ensureTable(config.DBName, "ScheduledNotification", mysql_create_scheduled)
+	b.ensureTable(config.DBName, "NotificationCenter", mysql_create_centers)
+	b.ensureTable(config.DBName, "PushSubscription", mysql_create_subscriptions)
+
+	return b
+}
+
+// Checks if the table exists. If not, creates it.
+func (b *MySQLBackend) ensureTable(dbname, table, create string) {
+	row := b.connection.QueryRow("SELECT COUNT(*) > 0 FROM information_schema.tables WHERE table_schema = ? AND table_name = ?", dbname, table)
 	var exists bool
-	if err = row.Scan(&exists); err != nil {
+	if err := row.Scan(&exists); err != nil {
 		log.Fatal(err)
 	}
 
 	if exists {
-		log.Println("APIToken table exists.")
+		log.Printf("%s table exists.\n", table)
 	} else {
-		log.Println("APIToken table does not exists, creating.")
-		_, err = b.connection.Exec(mysql_create_database)
-		if err != nil {
+		log.Printf("%s table does not exists, creating.\n", table)
+		if _, err := b.connection.Exec(create); err != nil {
 			log.Fatal(err)
 		}
 	}
-
-	return b
 }
 
 func (b *MySQLBackend) Stop() {
@@ -127,3 +165,159 @@ func (b *MySQLBackend) Remove(mail string) error {
 
 	return nil
 }
+
+func (b *MySQLBackend) GetScheduled() ([]ScheduledNotification, error) {
+	rows, err := b.connection.Query("SELECT ID, Mail, Center, Message, DeliverAt, TTL FROM ScheduledNotification ORDER BY DeliverAt")
+	if err != nil {
+		return nil, err
+	}
+
+	return scanScheduled(rows)
+}
+
+func (b *MySQLBackend) GetUserScheduled(mail string) ([]ScheduledNotification, error) {
+	rows, err := b.connection.Query("SELECT ID, Mail, Center, Message, DeliverAt, TTL FROM ScheduledNotification WHERE Mail = ? ORDER BY DeliverAt", mail)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanScheduled(rows)
+}
+
+func scanScheduled(rows *sql.Rows) ([]ScheduledNotification, error) {
+	defer rows.Close()
+
+	var list []ScheduledNotification
+
+	for rows.Next() {
+		var n ScheduledNotification
+		rows.Scan(&n.ID, &n.Mail, &n.Center, &n.Message, &n.DeliverAt, &n.TTL)
+		list = append(list, n)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (b *MySQLBackend) AddScheduled(n *ScheduledNotification) error {
+	if _, err := b.connection.Exec("INSERT INTO ScheduledNotification(ID, Mail, Center, Message, DeliverAt, TTL) VALUES(?,?,?,?,?,?)", n.ID, n.Mail, n.Center, n.Message, n.DeliverAt, n.TTL); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *MySQLBackend) RemoveScheduled(id string) (bool, error) {
+	return removedRows(b.connection.Exec("DELETE FROM ScheduledNotification WHERE ID = ?", id))
+}
+
+func (b *MySQLBackend) CancelScheduled(mail, id string) (bool, error) {
+	return removedRows(b.connection.Exec("DELETE FROM ScheduledNotification WHERE ID = ? AND Mail = ?", id, mail))
+}
+
+func removedRows(result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return removed > 0, nil
+}
+
+func (b *MySQLBackend) GetCenters() ([]StoredCenter, error) {
+	rows, err := b.connection.Query("SELECT Name, Mail, Center, Options, Created, State, StateExpires FROM NotificationCenter ORDER BY Created")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []StoredCenter
+
+	for rows.Next() {
+		var c StoredCenter
+		rows.Scan(&c.Name, &c.Mail, &c.Center, &c.Options, &c.Created, &c.State, &c.StateExpires)
+		list = append(list, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (b *MySQLBackend) SaveCenter(c *StoredCenter) error {
+	if _, err := b.connection.Exec("REPLACE INTO NotificationCenter(Name, Mail, Center, Options, Created, State, StateExpires) VALUES(?,?,?,?,?,?,?)", c.Name, c.Mail, c.Center, c.Options, c.Created, c.State, c.StateExpires); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *MySQLBackend) SaveCenterState(name, state string, expires int64) error {
+	if _, err := b.connection.Exec("UPDATE NotificationCenter SET State = ?, StateExpires = ? WHERE Name = ?", state, expires, name); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *MySQLBackend) RemoveCenter(name string) error {
+	if _, err := b.connection.Exec("DELETE FROM NotificationCenter WHERE Name = ?", name); err != nil {
+		return err
+	}
+
+	if _, err := b.connection.Exec("DELETE FROM PushSubscription WHERE Center = ?", name); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func endpointHash(endpoint string) string {
+	digest := sha256.Sum256([]byte(endpoint))
+	return hex.EncodeToString(digest[:])
+}
+
+func (b *MySQLBackend) GetPushSubscriptions(name string) ([]string, error) {
+	rows, err := b.connection.Query("SELECT Subscription FROM PushSubscription WHERE Center = ?", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []string
+
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		list = append(list, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (b *MySQLBackend) SavePushSubscription(name, endpoint, subscription string) error {
+	if _, err := b.connection.Exec("REPLACE INTO PushSubscription(Center, EndpointHash, Subscription) VALUES(?,?,?)", name, endpointHash(endpoint), subscription); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *MySQLBackend) RemovePushSubscription(name, endpoint string) error {
+	if _, err := b.connection.Exec("DELETE FROM PushSubscription WHERE Center = ? AND EndpointHash = ?", name, endpointHash(endpoint)); err != nil {
+		return err
+	}
+
+	return nil
+}
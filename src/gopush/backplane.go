@@ -0,0 +1,34 @@
+package gopush
+
+// Connects the nodes of a cluster. Every node publishes the notifications and the changes of the centers, and
+// applies the events of the other nodes.
+type Backplane interface {
+	// Sends an event to every node. The sender might get it back too.
+	Publish(e *BackplaneEvent) error
+	// Starts delivering the events to the handler, one after the other.
+	Subscribe(handler func(e *BackplaneEvent)) error
+	Close()
+}
+
+// Kinds of the backplane events
+const (
+	eventNotify       = "notify"
+	eventNewCenter    = "newcenter"
+	eventRemoveCenter = "removecenter"
+	eventOptions      = "options" // The webhooks or the push subscriptions of a center changed.
+	eventTouch        = "touch"   // Listener activity, which postpones the idle timeout.
+)
+
+type BackplaneEvent struct {
+	Node    string `json:"node"`
+	Kind    string `json:"kind"`
+	Name    string `json:"name"` // The public name of the center.
+	Mail    string `json:"mail,omitempty"`
+	Center  string `json:"center,omitempty"`
+	Options string `json:"options,omitempty"` // JSON encoded centerOptions
+	Created int64  `json:"created,omitempty"`
+	Message string `json:"message,omitempty"`
+	Patch   string `json:"patch,omitempty"`
+	Expires int64  `json:"expires,omitempty"` // Unix timestamp in milliseconds, zero if the message does not expire.
+	Code    int    `json:"code,omitempty"`    // Close code of a removed center.
+}
@@ -0,0 +1,75 @@
+package gopush
+
+import (
+	"sync"
+)
+
+const localBackplaneQueueSize = 1024
+
+// Connects the services of one process, mainly for testing.
+type LocalBus struct {
+	lock       sync.Mutex
+	backplanes map[*LocalBackplane]bool
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{backplanes: make(map[*LocalBackplane]bool)}
+}
+
+// The backplane of one service on a LocalBus.
+type LocalBackplane struct {
+	bus    *LocalBus
+	events chan *BackplaneEvent
+	quit   chan bool
+}
+
+func NewLocalBackplane(bus *LocalBus) *LocalBackplane {
+	return &LocalBackplane{
+		bus:    bus,
+		events: make(chan *BackplaneEvent, localBackplaneQueueSize),
+		quit:   make(chan bool),
+	}
+}
+
+func (b *LocalBackplane) Publish(e *BackplaneEvent) error {
+	b.bus.lock.Lock()
+	defer b.bus.lock.Unlock()
+
+	for other := range b.bus.backplanes {
+		// Every node gets its own copy, like over the network.
+		copied := *e
+		select {
+		case other.events <- &copied:
+		case <-other.quit:
+		}
+	}
+
+	return nil
+}
+
+func (b *LocalBackplane) Subscribe(handler func(e *BackplaneEvent)) error {
+	b.bus.lock.Lock()
+	b.bus.backplanes[b] = true
+	b.bus.lock.Unlock()
+
+	go func() {
+		for {
+			select {
+			case e := <-b.events:
+				handler(e)
+			case <-b.quit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *LocalBackplane) Close() {
+	b.bus.lock.Lock()
+	delete(b.bus.backplanes, b)
+	b.bus.lock.Unlock()
+
+	close(b.quit)
+}
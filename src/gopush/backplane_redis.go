@@ -0,0 +1,149 @@
+package gopush
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"log"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const redisReconnectDelay = 5 * time.Second
+
+var errBackplaneClosed = errors.New("backplane is closed")
+
+// Publishes the events on a Redis pub/sub channel. The events published while a node is disconnected from Redis
+// are lost for that node.
+type RedisBackplane struct {
+	address string
+	channel string
+	pool    *redis.Pool
+	lock    sync.Mutex
+	psc     *redis.PubSubConn
+	closed  bool
+}
+
+func NewRedisBackplane(address, channel string) *RedisBackplane {
+	dial := func() (redis.Conn, error) {
+		return redis.Dial("tcp", address, redis.DialConnectTimeout(10*time.Second))
+	}
+
+	return &RedisBackplane{
+		address: address,
+		channel: channel,
+		pool: &redis.Pool{
+			MaxIdle:     4,
+			IdleTimeout: 4 * time.Minute,
+			Dial:        dial,
+		},
+	}
+}
+
+func (b *RedisBackplane) Publish(e *BackplaneEvent) error {
+	marshaled, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", b.channel, marshaled)
+	return err
+}
+
+// The first connection is made before returning, so a wrong address is reported right away.
+func (b *RedisBackplane) Subscribe(handler func(e *BackplaneEvent)) error {
+	psc, err := b.subscribe()
+	if err != nil {
+		return err
+	}
+
+	go b.receive(psc, handler)
+
+	return nil
+}
+
+func (b *RedisBackplane) subscribe() (*redis.PubSubConn, error) {
+	conn, err := redis.Dial("tcp", b.address, redis.DialConnectTimeout(10*time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	psc := &redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(b.channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		conn.Close()
+		return nil, errBackplaneClosed
+	}
+	b.psc = psc
+
+	return psc, nil
+}
+
+func (b *RedisBackplane) isClosed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.closed
+}
+
+// Receives the events, and reconnects if the connection is lost.
+func (b *RedisBackplane) receive(psc *redis.PubSubConn, handler func(e *BackplaneEvent)) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			var e BackplaneEvent
+			if err := json.Unmarshal(v.Data, &e); err != nil {
+				log.Printf("Invalid backplane event: %s\n", err.Error())
+				continue
+			}
+			handler(&e)
+		case error:
+			psc.Close()
+			if b.isClosed() {
+				return
+			}
+
+			log.Printf("Lost the connection to the Redis backplane: %s\n", v.Error())
+			for {
+				time.Sleep(redisReconnectDelay)
+				if b.isClosed() {
+					return
+				}
+
+				var err error
+				if psc, err = b.subscribe(); err == nil {
+					log.Println("Reconnected to the Redis backplane.")
+					break
+				}
+				if err == errBackplaneClosed {
+					return
+				}
+				log.Printf("Failed to reconnect to the Redis backplane: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+func (b *RedisBackplane) Close() {
+	b.lock.Lock()
+	b.closed = true
+	psc := b.psc
+	b.lock.Unlock()
+
+	if psc != nil {
+		psc.Close()
+	}
+	b.pool.Close()
+}
@@ -0,0 +1,224 @@
+package gopush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"log"
+)
+
+type batchItem struct {
+	Center  string `json:"center"`
+	Message string `json:"message"`
+	TTL     int64  `json:"ttl"` // Seconds
+}
+
+type batchResult struct {
+	Center string `json:"center"`
+	ID     string `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type broadcastResult struct {
+	Centers   int `json:"centers"`
+	Listeners int `json:"listeners"`
+}
+
+// Returns the names of the centers of a publisher, optionally filtered by a glob pattern on the center identifier.
+func (svc *GoPushService) findCenters(mail, pattern string) ([]string, error) {
+	var centernames []string
+
+	svc.centersLock.RLock()
+	defer svc.centersLock.RUnlock()
+
+	for centername, c := range svc.centers {
+		if c.mail != mail {
+			continue
+		}
+
+		if pattern != "" {
+			matched, err := path.Match(pattern, c.center)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		centernames = append(centernames, centername)
+	}
+
+	return centernames, nil
+}
+
+func (svc *GoPushService) handleNotifyBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+
+	centernames, err := svc.findCenters(mail, v.Get("pattern"))
+	if err != nil {
+		serve400(w, err)
+		return
+	}
+
+	ttl, err := parseTTL(v)
+	if err != nil {
+		serve400(w, err)
+		return
+	}
+
+	var result broadcastResult
+	for _, centername := range centernames {
+		if _, err := svc.notify(centername, string(body), ttl); err == nil {
+			result.Centers++
+			// The center might be removed in the meantime.
+			if hub, ok := svc.getHub(centername); ok {
+				p, _ := hub.queryPresence()
+				result.Listeners += p.Listeners
+			}
+		}
+	}
+
+	// The other nodes notify their own centers.
+	for peer, b := range svc.fanOut(r, body) {
+		var other broadcastResult
+		if err := json.Unmarshal(b, &other); err != nil {
+			log.Printf("Invalid broadcast result from %s: %s\n", peer, err.Error())
+			continue
+		}
+		result.Centers += other.Centers
+		result.Listeners += other.Listeners
+	}
+
+	marshaled, err := json.Marshal(result)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaled)
+}
+
+// Returns the owner of the center of a batch item, or an empty string if this node serves it. The requests forwarded
+// by another node are served locally.
+func (svc *GoPushService) batchOwner(r *http.Request, mail string, item batchItem) string {
+	if svc.ring == nil || item.Center == "" {
+		return ""
+	}
+
+	owner := svc.ring.owner(getCenterName(mail, item.Center))
+	if owner == svc.config.PeerURL {
+		return ""
+	}
+	if r.Header.Get(forwardedHeader) != "" {
+		return ""
+	}
+
+	return owner
+}
+
+func (svc *GoPushService) handleNotifyBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+
+	var items []batchItem
+	if err := json.Unmarshal(body, &items); err != nil {
+		serve400(w, err)
+		return
+	}
+
+	// Centers are namespaced by the mail address, so a center of another publisher is simply not found. The items of
+	// the centers of other nodes are sent there.
+	results := make([]batchResult, len(items))
+	remote := make(map[int]string)
+	for i, item := range items {
+		results[i].Center = item.Center
+		if owner := svc.batchOwner(r, mail, item); owner != "" {
+			remote[i] = owner
+			continue
+		}
+
+		if item.TTL < 0 {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = errInvalidTTL.Error()
+			continue
+		}
+
+		if item.Center == "" {
+			results[i].Status = http.StatusNotFound
+			results[i].Error = "Not Found"
+			continue
+		}
+
+		id, err := svc.notify(svc.lookupCenter(mail, item.Center), item.Message, time.Duration(item.TTL)*time.Second)
+		if err != nil {
+			results[i].Status = notifyErrorStatus(err)
+			results[i].Error = err.Error()
+			continue
+		}
+
+		results[i].Status = http.StatusOK
+		results[i].ID = id
+	}
+
+	if len(remote) > 0 {
+		others := make(map[string][]batchResult)
+		for peer, b := range svc.fanOut(r, body) {
+			var list []batchResult
+			if err := json.Unmarshal(b, &list); err != nil || len(list) != len(items) {
+				log.Printf("Invalid batch result from %s.\n", peer)
+				continue
+			}
+			others[peer] = list
+		}
+
+		for i, owner := range remote {
+			if list, ok := others[owner]; ok {
+				results[i] = list[i]
+			} else {
+				results[i].Status = http.StatusBadGateway
+				results[i].Error = http.StatusText(http.StatusBadGateway)
+			}
+		}
+	}
+
+	marshaled, err := json.Marshal(results)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaled)
+}
@@ -0,0 +1,106 @@
+package gopush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+
+	"log"
+)
+
+type centerInfo struct {
+	Center      string `json:"center"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Creator     string `json:"creator"`
+	Created     int64  `json:"created"`
+	LastNotify  int64  `json:"lastnotify"`
+	Listeners   int    `json:"listeners"`
+}
+
+type centerInfoByName []centerInfo
+
+func (s centerInfoByName) Len() int           { return len(s) }
+func (s centerInfoByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s centerInfoByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// Returns false if the center was removed in the meantime.
+func (svc *GoPushService) getCenterInfo(centername string) (centerInfo, bool) {
+	c, ok := svc.getCenter(centername)
+	if !ok {
+		return centerInfo{}, false
+	}
+	hub, ok := svc.getHub(centername)
+	if !ok {
+		return centerInfo{}, false
+	}
+	p, ok := hub.queryPresence()
+	if !ok {
+		return centerInfo{}, false
+	}
+
+	return centerInfo{
+		Center:      c.center,
+		Name:        centername,
+		Description: c.options.Description,
+		Creator:     c.mail,
+		Created:     c.created,
+		LastNotify:  atomic.LoadInt64(&c.lastNotify),
+		Listeners:   p.Listeners,
+	}, true
+}
+
+// The request is signed like the POST requests, with an empty body.
+func (svc *GoPushService) handleCenters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+
+	centernames, err := svc.findCenters(mail, v.Get("pattern"))
+	if err != nil {
+		serve400(w, err)
+		return
+	}
+
+	list := []centerInfo{}
+	for _, centername := range centernames {
+		if info, ok := svc.getCenterInfo(centername); ok {
+			list = append(list, info)
+		}
+	}
+
+	// The other nodes list their own centers.
+	for peer, b := range svc.fanOut(r, body) {
+		var other []centerInfo
+		if err := json.Unmarshal(b, &other); err != nil {
+			log.Printf("Invalid list of centers from %s: %s\n", peer, err.Error())
+			continue
+		}
+		list = append(list, other...)
+	}
+
+	sort.Sort(centerInfoByName(list))
+
+	marshaled, err := json.Marshal(list)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaled)
+}
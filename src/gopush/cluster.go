@@ -0,0 +1,192 @@
+package gopush
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"log"
+)
+
+// Joins a cluster through a backplane. The notifications and the changes of the centers are published to the other
+// nodes, and their events are applied to the centers of this node. It must be called before Start.
+func (svc *GoPushService) SetBackplane(b Backplane) error {
+	if err := b.Subscribe(svc.handleBackplaneEvent); err != nil {
+		return err
+	}
+
+	svc.backplane = b
+	log.Printf("Joined the cluster as node %s.\n", svc.node)
+
+	return nil
+}
+
+func (svc *GoPushService) publish(e *BackplaneEvent) {
+	if svc.backplane == nil {
+		return
+	}
+
+	e.Node = svc.node
+	if err := svc.backplane.Publish(e); err != nil {
+		log.Printf("Failed to publish a backplane event: %s\n", err.Error())
+	}
+}
+
+func (svc *GoPushService) publishCenter(c *notificationCenter, centername string) {
+	options, err := json.Marshal(c.options)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	svc.publish(&BackplaneEvent{
+		Kind:    eventNewCenter,
+		Name:    centername,
+		Mail:    c.mail,
+		Center:  c.center,
+		Options: string(options),
+		Created: c.created,
+	})
+}
+
+// The caller must hold the webhook lock of the center.
+func (svc *GoPushService) publishOptions(c *notificationCenter, centername string) {
+	options, err := json.Marshal(c.options)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	svc.publish(&BackplaneEvent{Kind: eventOptions, Name: centername, Options: string(options)})
+}
+
+func (svc *GoPushService) publishNotification(centername string, m *hubMessage) {
+	e := &BackplaneEvent{Kind: eventNotify, Name: centername, Message: m.data, Patch: m.patch}
+	if !m.expires.IsZero() {
+		e.Expires = m.expires.UnixNano() / int64(time.Millisecond)
+	}
+
+	svc.publish(e)
+}
+
+// The events are applied one after the other. The backend is shared by the nodes, so only the node which made a
+// change saves it.
+func (svc *GoPushService) handleBackplaneEvent(e *BackplaneEvent) {
+	if e.Node == svc.node {
+		return
+	}
+
+	if svc.config.ExtraLogging {
+		log.Printf("Backplane event from %s: %s %s\n", e.Node, e.Kind, e.Name)
+	}
+
+	switch e.Kind {
+	case eventNotify:
+		svc.applyNotification(e)
+	case eventNewCenter:
+		svc.applyNewCenter(e)
+	case eventRemoveCenter:
+		// The center might have been recreated with another name since.
+		if svc.lookupCenter(e.Mail, e.Center) == e.Name {
+			svc.dropCenter(e.Mail, e.Center, e.Code)
+		}
+	case eventOptions:
+		svc.applyOptions(e)
+	case eventTouch:
+		if c, ok := svc.getCenter(e.Name); ok {
+			c.touch()
+		}
+	}
+}
+
+func (svc *GoPushService) applyNotification(e *BackplaneEvent) {
+	c, ok := svc.getCenter(e.Name)
+	if !ok {
+		return
+	}
+	hub, ok := svc.getHub(e.Name)
+	if !ok {
+		return
+	}
+
+	var ttl time.Duration
+	if e.Expires > 0 {
+		ttl = time.Unix(0, e.Expires*int64(time.Millisecond)).Sub(time.Now())
+		if ttl <= 0 {
+			return
+		}
+	}
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	m := &hubMessage{data: e.Message, patch: e.Patch, remote: true}
+
+	c.touch()
+	atomic.StoreInt64(&c.lastNotify, time.Now().Unix())
+
+	svc.setStateExpiry(c, e.Name, m, ttl)
+	svc.setState(e.Name, m.data)
+
+	hub.post(m)
+}
+
+func (svc *GoPushService) applyNewCenter(e *BackplaneEvent) {
+	c := &notificationCenter{
+		mail:    e.Mail,
+		center:  e.Center,
+		created: e.Created,
+	}
+	if err := json.Unmarshal([]byte(e.Options), &c.options); err != nil {
+		log.Printf("Failed to open notification center %s of the cluster: %s\n", e.Name, err.Error())
+		return
+	}
+
+	up, err := svc.newCenterUpstream(e.Name, c.options)
+	if err != nil {
+		log.Printf("Failed to open notification center %s of the cluster: %s\n", e.Name, err.Error())
+		return
+	}
+
+	// Opening the center replaces the old one.
+	svc.openCenter(c, e.Name, c.options.DefaultState, up)
+}
+
+// Applies the webhooks and the push subscriptions of a center.
+func (svc *GoPushService) applyOptions(e *BackplaneEvent) {
+	c, ok := svc.getCenter(e.Name)
+	if !ok {
+		return
+	}
+
+	var options centerOptions
+	if err := json.Unmarshal([]byte(e.Options), &options); err != nil {
+		log.Printf("Failed to update notification center %s of the cluster: %s\n", e.Name, err.Error())
+		return
+	}
+
+	c.webhookLock.Lock()
+	defer c.webhookLock.Unlock()
+
+	webhooks := make(map[string]bool)
+	for _, o := range options.Webhooks {
+		webhooks[o.ID] = true
+		if _, ok := c.webhooks[o.ID]; !ok {
+			svc.startWebhook(c, e.Name, o)
+		}
+	}
+	for id, w := range c.webhooks {
+		if !webhooks[id] {
+			delete(c.webhooks, id)
+			w.stop()
+		}
+	}
+	c.options.Webhooks = options.Webhooks
+
+	c.options.WebPush = options.WebPush
+	if c.webPush != nil {
+		c.webPush.reset(options.WebPush)
+	} else {
+		svc.startWebPush(c, e.Name)
+	}
+}
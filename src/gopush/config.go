@@ -17,8 +17,43 @@ type Config struct {
 	Timeout          int64
 	UserCache        bool
 	BroadcastBuffer  int64
+	SendBuffer       int64
 	ExtraLogging     bool
 	RedirectMainPage string
+	// Limits of the messages sent by the websocket clients to the upstream of a notification center.
+	UpstreamMaxMessageSize int64
+	UpstreamRateLimit      int64
+	UpstreamUnixSocket     bool
+	// Seconds while the idempotency keys of the notifications are remembered.
+	IdempotencyWindow int64
+	// Seconds while the delivery reports of the messages are kept.
+	DeliveryReportRetention int64
+	// Seconds between the pings sent to the websocket clients, and without any data from them.
+	PingInterval int64
+	ReadTimeout  int64
+	// New centers get random public names by default, instead of the mail and the center identifier.
+	OpaqueCenterNames bool
+	// Attempts of a webhook delivery, and seconds before the first retry. The delay doubles with every retry.
+	WebhookMaxAttempts int64
+	WebhookRetryDelay  int64
+	// Application server key of Web Push: base64url encoded P-256 private key, and the contact of the VAPID claims.
+	VAPIDPrivateKey string
+	VAPIDSubject    string
+	// Allows http:// push endpoints, for testing with a local push service.
+	WebPushInsecureEndpoints bool
+	// Allows the destinations on loopback, private and link-local addresses.
+	PrivateDestinations bool
+	// Address of the Redis server which connects the nodes of a cluster, empty if the node runs alone, and the
+	// pub/sub channel of the cluster.
+	RedisBackplane string
+	RedisChannel   string
+	// Base URLs of the nodes which share the centers by consistent hashing, including the URL of this node, and
+	// how the requests of the centers of the other nodes are handled: redirect or proxy.
+	Peers       []string
+	PeerURL     string
+	PeerRouting string
+	// Seconds to finish the requests in progress and to close the connections when the service stops.
+	ShutdownTimeout int64
 }
 
 func ReadConfig(path string) (Config, error) {
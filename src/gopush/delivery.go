@@ -0,0 +1,234 @@
+package gopush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log"
+)
+
+const defaultDeliveryReportRetention = time.Hour
+
+// Number of delivery reports kept. The oldest reports are dropped before their retention time ends if there are
+// more.
+const deliveryReportLimit = 100000
+
+// Number of unacknowledged messages remembered per connection. The acknowledgements of older messages are ignored.
+const pendingAcksLimit = 1000
+
+// Delivery statistics of a message. The counters are updated concurrently by the hub and the connections.
+type deliveryReport struct {
+	id         string
+	mail       string
+	center     string
+	time       int64
+	recipients int64
+	delivered  int64
+	acked      int64
+	dropped    int64
+}
+
+type deliveryReportData struct {
+	ID         string `json:"id"`
+	Time       int64  `json:"time"`
+	Recipients int64  `json:"recipients"`
+	Delivered  int64  `json:"delivered"`
+	Acked      int64  `json:"acked"`
+	Dropped    int64  `json:"dropped"`
+}
+
+func (r *deliveryReport) snapshot() deliveryReportData {
+	return deliveryReportData{
+		ID:         r.id,
+		Time:       r.time,
+		Recipients: atomic.LoadInt64(&r.recipients),
+		Delivered:  atomic.LoadInt64(&r.delivered),
+		Acked:      atomic.LoadInt64(&r.acked),
+		Dropped:    atomic.LoadInt64(&r.dropped),
+	}
+}
+
+// The reports are kept for the retention time after the message is sent, at most deliveryReportLimit of them. The
+// reports are created in order, so the oldest ones are at the front of the queue.
+type deliveryReports struct {
+	lock      sync.Mutex
+	reports   map[string]*deliveryReport
+	order     []*deliveryReport
+	retention time.Duration
+}
+
+func newDeliveryReports(retention int64) *deliveryReports {
+	r := &deliveryReports{
+		reports:   make(map[string]*deliveryReport),
+		retention: defaultDeliveryReportRetention,
+	}
+
+	if retention > 0 {
+		r.retention = time.Duration(retention) * time.Second
+	}
+
+	return r
+}
+
+func (r *deliveryReports) create(mail, centername string) *deliveryReport {
+	report := &deliveryReport{
+		id:     genRandomHash(64),
+		mail:   mail,
+		center: centername,
+		time:   time.Now().Unix(),
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.reports[report.id] = report
+	r.order = append(r.order, report)
+	r.prune(time.Now())
+
+	return report
+}
+
+// Drops the expired reports and the oldest ones above the limit. Must be called with the lock held.
+func (r *deliveryReports) prune(now time.Time) {
+	expired := now.Add(-r.retention).Unix()
+	n := 0
+	for n < len(r.order) && (len(r.order)-n > deliveryReportLimit || r.order[n].time < expired) {
+		delete(r.reports, r.order[n].id)
+		r.order[n] = nil
+		n++
+	}
+	r.order = r.order[n:]
+}
+
+func (r *deliveryReports) get(id string) *deliveryReport {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.prune(time.Now())
+
+	return r.reports[id]
+}
+
+// Message format for the clients which acknowledge the messages.
+type ackEnvelope struct {
+	ID      string `json:"id,omitempty"`
+	Message string `json:"message"`
+}
+
+type ackFrame struct {
+	Ack string `json:"ack"`
+}
+
+func encodeAckEnvelope(m *hubMessage, data string) string {
+	marshaled, err := json.Marshal(ackEnvelope{ID: m.id(), Message: data})
+	if err != nil {
+		log.Println(err.Error())
+		return ""
+	}
+
+	return string(marshaled)
+}
+
+// The messages delivered to a connection which were not acknowledged yet. A message counts as acknowledged once,
+// and only on a connection which got it.
+type pendingAcks struct {
+	lock    sync.Mutex
+	reports map[string]*deliveryReport
+	order   []string
+}
+
+func newPendingAcks() *pendingAcks {
+	return &pendingAcks{reports: make(map[string]*deliveryReport)}
+}
+
+func (p *pendingAcks) add(report *deliveryReport) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.reports[report.id]; ok {
+		return
+	}
+
+	p.reports[report.id] = report
+	p.order = append(p.order, report.id)
+	if len(p.order) > pendingAcksLimit {
+		delete(p.reports, p.order[0])
+		p.order = p.order[1:]
+	}
+}
+
+// Forgets a message which could not be delivered.
+func (p *pendingAcks) remove(id string) {
+	p.lock.Lock()
+	delete(p.reports, id)
+	p.lock.Unlock()
+}
+
+// Counts the acknowledgement of a message. Unknown and repeated acknowledgements are ignored.
+func (p *pendingAcks) ack(id string) {
+	p.lock.Lock()
+	report, ok := p.reports[id]
+	delete(p.reports, id)
+	p.lock.Unlock()
+
+	if ok {
+		atomic.AddInt64(&report.acked, 1)
+	}
+}
+
+// Returns true if the message of the client is an acknowledgement.
+func (c *wsconnection) handleAck(message string) bool {
+	var frame ackFrame
+	if err := json.Unmarshal([]byte(message), &frame); err != nil || frame.Ack == "" {
+		return false
+	}
+
+	c.acks.ack(frame.Ack)
+
+	return true
+}
+
+func (svc *GoPushService) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+
+	report := svc.reports.get(string(body))
+	if report == nil || report.mail != mail {
+		// The report is kept by the node which sent the notification.
+		for _, b := range svc.fanOut(r, body) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			w.Write(b)
+			return
+		}
+
+		serve404(w)
+		return
+	}
+
+	marshaled, err := json.Marshal(report.snapshot())
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaled)
+}
@@ -0,0 +1,74 @@
+package gopush
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// The destinations of the requests of the service come from the publishers and the browsers, so the service does not
+// connect to loopback, private and link-local addresses, unless the privatedestinations option allows it.
+
+var (
+	errPrivateDestination    = errors.New("Destination resolves to a loopback, private or link-local address.")
+	errUnresolvedDestination = errors.New("Destination host can't be resolved.")
+)
+
+func isPrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// Resolves the host of a destination URL, every address of the host must be public.
+func checkDestination(destination string, config Config) error {
+	if config.PrivateDestinations {
+		return nil
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return err
+	}
+
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return errUnresolvedDestination
+	}
+	for _, ip := range ips {
+		if isPrivateAddress(ip) {
+			return errPrivateDestination
+		}
+	}
+
+	return nil
+}
+
+// The addresses are checked again when they are connected, because a host might resolve to another address by then,
+// and redirects are followed.
+func newDestinationClient(config Config) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !config.PrivateDestinations {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateAddress(ip) {
+				return errPrivateDestination
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,131 @@
+package gopush
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"log"
+)
+
+var errInvalidLifetime = errors.New("Invalid lifetime or idletimeout parameter.")
+
+// Parses a number of seconds. Empty means the default (-1), "never" means no expiry (0).
+func parseExpiry(v url.Values, name string) (int64, error) {
+	value := v.Get(name)
+	switch value {
+	case "":
+		return -1, nil
+	case "never":
+		return 0, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, errInvalidLifetime
+	}
+
+	return seconds, nil
+}
+
+// Returns the time when the lifetime of the center ends, or the zero time if it never expires.
+func (svc *GoPushService) centerDeadline(c *notificationCenter) time.Time {
+	lifetime := c.options.Lifetime
+	if lifetime < 0 {
+		lifetime = svc.config.Timeout
+	}
+
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(c.created, 0).Add(time.Duration(lifetime) * time.Second)
+}
+
+// Starts the timers which remove the center after its lifetime, or when it is idle for too long.
+func (svc *GoPushService) startCenterExpiry(c *notificationCenter, mail, center string) {
+	deadline := svc.centerDeadline(c)
+
+	c.expiryLock.Lock()
+	defer c.expiryLock.Unlock()
+
+	if !deadline.IsZero() {
+		c.lifetimeTimer = time.AfterFunc(deadline.Sub(time.Now()), func() {
+			svc.expireCenter(c, mail, center, "lifetime")
+		})
+	}
+
+	if c.options.IdleTimeout > 0 {
+		c.idleTimeout = time.Duration(c.options.IdleTimeout) * time.Second
+		c.idleTimer = time.AfterFunc(c.idleTimeout, func() {
+			svc.expireCenter(c, mail, center, "idle timeout")
+		})
+	}
+}
+
+// Postpones the idle timeout. It is called on every notification and listener activity.
+func (c *notificationCenter) touch() {
+	c.expiryLock.Lock()
+	defer c.expiryLock.Unlock()
+
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+}
+
+// Postpones the idle timeout on the listener activity of this node. Returns true if the other nodes should be told,
+// at most once in a quarter of the idle timeout.
+func (c *notificationCenter) touchShared() bool {
+	c.expiryLock.Lock()
+	defer c.expiryLock.Unlock()
+
+	if c.idleTimer == nil {
+		return false
+	}
+	c.idleTimer.Reset(c.idleTimeout)
+
+	now := time.Now()
+	if now.Sub(c.sharedTouch) < c.idleTimeout/4 {
+		return false
+	}
+	c.sharedTouch = now
+
+	return true
+}
+
+// Every node of a cluster runs the idle timer of the center, and the first one which fires removes the center, so the
+// listener activity is shared. The notifications are shared anyway. The hub must not wait for the backplane.
+func (svc *GoPushService) listenerActivity(c *notificationCenter, centername string) {
+	if c.touchShared() && svc.backplane != nil {
+		go svc.publish(&BackplaneEvent{Kind: eventTouch, Name: centername})
+	}
+}
+
+func (c *notificationCenter) stopExpiry() {
+	c.expiryLock.Lock()
+	defer c.expiryLock.Unlock()
+
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+		c.lifetimeTimer = nil
+	}
+
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+}
+
+func (svc *GoPushService) expireCenter(c *notificationCenter, mail, center, reason string) {
+	centername := svc.lookupCenter(mail, center)
+
+	// The center might have been removed and recreated since the timer started.
+	if current, _ := svc.getCenter(centername); current != c {
+		return
+	}
+
+	log.Printf("Notification center expired (%s): %s\n", reason, centername)
+
+	svc.removeCenter(mail, center, closeCenterExpired)
+}
@@ -1,11 +1,14 @@
 package gopush
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"net"
 	"net/http"
-	"net/url"
+	"net/http/httputil"
+	"sync"
+	"time"
 
 	"code.google.com/p/go.net/websocket"
 
@@ -13,20 +16,47 @@ import (
 )
 
 type GoPushService struct {
-	keySize       int
-	authName      string
+	keySize    int
+	authName   string
+	config     Config
+	adminCreds string
+	server     *http.Server
+	// The centers by their public names, their hubs and last states, and the public names by the mail and the
+	// center identifier. They are changed by the handlers, the timers and the backplane, so centersLock guards
+	// them.
+	centersLock   sync.RWMutex
 	lastState     map[string]string
-	config        Config
-	adminCreds    string
-	server        *http.Server
 	hubs          map[string]*wshub
+	centers       map[string]*notificationCenter
+	centerNames   map[string]string
+	reports       *deliveryReports
 	listener      net.Listener
 	backend       Backend
 	outputmanager OutputManager
+	scheduled     map[string]*scheduledDelivery
+	scheduledLock sync.Mutex
+	// Guards the idempotency keys of the centers.
+	idempotencyLock sync.Mutex
+	vapid           *vapidKeys
+	// Nil if the node is not part of a cluster.
+	backplane Backplane
+	node      string
+	// Nil if the centers are not sharded.
+	ring    *hashRing
+	routing string
+	proxies map[string]*httputil.ReverseProxy
+	// The open websocket connections, and whether the service is shutting down. GoingAway is closed when the
+	// centers are closed.
+	connectionLock  sync.Mutex
+	connections     map[*websocket.Conn]bool
+	connectionGroup sync.WaitGroup
+	stopping        bool
+	goingAway       chan bool
 }
 
 func NewService(config Config, backend Backend, outputmanager OutputManager) *GoPushService {
 	mux := http.NewServeMux()
+	config = checkKeepalive(config)
 
 	instance := &GoPushService{
 		keySize:    1024,
@@ -38,44 +68,74 @@ func NewService(config Config, backend Backend, outputmanager OutputManager) *Go
 			Handler: mux,
 		},
 		hubs:          make(map[string]*wshub),
+		centers:       make(map[string]*notificationCenter),
+		centerNames:   make(map[string]string),
+		reports:       newDeliveryReports(config.DeliveryReportRetention),
 		backend:       backend,
 		listener:      nil,
 		outputmanager: outputmanager,
+		scheduled:     make(map[string]*scheduledDelivery),
+		node:          genRandomHash(16),
+		connections:   make(map[*websocket.Conn]bool),
+		goingAway:     make(chan bool),
 	}
 
 	instance.config = config
 
 	log.Printf("Notification center timeout is set to %d second(s).\n", config.Timeout)
 
+	vapid, err := loadVAPIDKeys(config)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	instance.vapid = vapid
+
+	if err := instance.initSharding(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
 	instance.adminCreds = base64.StdEncoding.EncodeToString([]byte(config.AdminUser + ":" + config.AdminPass))
 
 	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) { instance.handleAdmin(w, r) })
 	mux.HandleFunc("/admin/add", func(w http.ResponseWriter, r *http.Request) { instance.handleAdminAdd(w, r) })
 	mux.HandleFunc("/admin/remove", func(w http.ResponseWriter, r *http.Request) { instance.handleAdminRemove(w, r) })
 
-	mux.HandleFunc("/newcenter", func(w http.ResponseWriter, r *http.Request) { instance.handleNewCenter(w, r) })
-	mux.HandleFunc("/notify", func(w http.ResponseWriter, r *http.Request) { instance.handleNotify(w, r) })
-	mux.HandleFunc("/removecenter", func(w http.ResponseWriter, r *http.Request) { instance.handleRemoveCenter(w, r) })
+	mux.Handle("/newcenter", instance.routed(routeByBody, http.HandlerFunc(instance.handleNewCenter)))
+	mux.Handle("/notify", instance.routed(routeByQuery, http.HandlerFunc(instance.handleNotify)))
+	mux.HandleFunc("/notify/broadcast", func(w http.ResponseWriter, r *http.Request) { instance.handleNotifyBroadcast(w, r) })
+	mux.HandleFunc("/notify/batch", func(w http.ResponseWriter, r *http.Request) { instance.handleNotifyBatch(w, r) })
+	mux.Handle("/removecenter", instance.routed(routeByBody, http.HandlerFunc(instance.handleRemoveCenter)))
+	mux.HandleFunc("/scheduled", func(w http.ResponseWriter, r *http.Request) { instance.handleScheduled(w, r) })
+	mux.HandleFunc("/scheduled/cancel", func(w http.ResponseWriter, r *http.Request) { instance.handleCancelScheduled(w, r) })
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) { instance.handleReport(w, r) })
+	mux.HandleFunc("/centers", func(w http.ResponseWriter, r *http.Request) { instance.handleCenters(w, r) })
+	mux.Handle("/stats", instance.routed(routeByBody, http.HandlerFunc(instance.handleStats)))
+	mux.Handle("/presence", instance.routed(routeByBody, http.HandlerFunc(instance.handlePresence)))
+	mux.Handle("/webhooks", instance.routed(routeByBody, http.HandlerFunc(instance.handleWebhooks)))
+	mux.Handle("/webhooks/add", instance.routed(routeByBody, http.HandlerFunc(instance.handleAddWebhook)))
+	mux.Handle("/webhooks/remove", instance.routed(routeByBody, http.HandlerFunc(instance.handleRemoveWebhook)))
 
 	mux.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) { instance.handleTest(w, r) })
 
-	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { instance.handlePing(w, r) })
-
-	mux.Handle("/listen", websocket.Handler(func(conn *websocket.Conn) {
-		v, _ := url.ParseQuery(conn.Request().URL.RawQuery)
-		center := v.Get("center")
-		if hub, ok := instance.hubs[center]; ok {
-			if instance.config.ExtraLogging {
-				log.Println("Client connected.")
-			}
-			wsHandler(conn, hub, instance.config.ExtraLogging)
-		} else {
-			if instance.config.ExtraLogging {
-				log.Println("Client connection rejected.")
-			}
-			conn.Close() // TODO figure out if it's possible to send an error message to the client
-		}
-	}))
+	mux.Handle("/ping", instance.routed(routeByPublicName, http.HandlerFunc(instance.handlePing)))
+
+	mux.HandleFunc("/webpush/key", func(w http.ResponseWriter, r *http.Request) { instance.handleVAPIDKey(w, r) })
+	mux.Handle("/webpush/subscribe", instance.routed(routeByPublicName, http.HandlerFunc(instance.handleWebPushSubscribe)))
+	mux.Handle("/webpush/unsubscribe", instance.routed(routeByPublicName, http.HandlerFunc(instance.handleWebPushUnsubscribe)))
+
+	// Only the listeners of a single center are routed, the multiplexed connections are served locally.
+	mux.Handle("/listen", instance.routed(routeByPublicName, withReadTimeout(websocket.Server{
+		Handshake: protocolHandshake(listenProtocols, true),
+		Handler:   instance.tracked(instance.handleListen),
+	}, time.Duration(config.ReadTimeout)*time.Second)))
+	// MQTT clients are not necessarily browsers, they might not send an origin.
+	mux.Handle("/mqtt", withReadTimeout(websocket.Server{
+		Handshake: protocolHandshake([]string{mqttProtocol}, false),
+		Handler:   instance.tracked(instance.mqttHandler),
+	}, time.Duration(config.ReadTimeout)*time.Second))
+
+	instance.restoreCenters()
+	instance.restoreScheduled()
 
 	if instance.config.RedirectMainPage != "" {
 		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -137,11 +197,73 @@ func (svc *GoPushService) Start() error {
 		log.Fatalln("Failed to initialize listener.")
 	}
 
-	return svc.server.Serve(svc.listener)
+	// Stop shuts the server down, it is not a failure.
+	if err := svc.server.Serve(svc.listener); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Closes the connections of the listeners and stops the timers of the centers, but keeps the centers in the
+// backend for the next start.
+func (svc *GoPushService) closeCenters(code int) {
+	svc.centersLock.Lock()
+	centers := make([]*notificationCenter, 0, len(svc.centers))
+	for _, c := range svc.centers {
+		centers = append(centers, c)
+	}
+	hubs := make([]*wshub, 0, len(svc.hubs))
+	for centername, hub := range svc.hubs {
+		hubs = append(hubs, hub)
+		delete(svc.hubs, centername)
+	}
+	svc.centersLock.Unlock()
+
+	for _, c := range centers {
+		svc.closeCenter(c, nil, code)
+	}
+	for _, hub := range hubs {
+		hub.close(code)
+	}
 }
 
+// Shuts down the service gracefully. It stops accepting connections, waits for the requests in progress, delivers
+// the queued messages and closes the websocket connections with the 1001 close code. The connections still open at
+// the shutdown timeout are cut off.
 func (svc *GoPushService) Stop() {
+	timeout := defaultShutdownTimeout
+	if svc.config.ShutdownTimeout > 0 {
+		timeout = time.Duration(svc.config.ShutdownTimeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	svc.connectionLock.Lock()
+	if svc.stopping {
+		svc.connectionLock.Unlock()
+		return
+	}
+	svc.stopping = true
+	svc.connectionLock.Unlock()
+
 	log.Println("Shutting down server.")
-	svc.listener.Close()
+
+	// The notifications in progress save the state of their centers before they return.
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := svc.server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to finish the requests in progress: %s\n", err.Error())
+	}
+
+	svc.stopScheduled()
+	if svc.backplane != nil {
+		svc.backplane.Close()
+	}
+	svc.closeCenters(closeGoingAway)
+	close(svc.goingAway)
+
+	svc.waitConnections(deadline)
 	svc.backend.Stop()
+
+	log.Println("Server stopped.")
 }
@@ -3,16 +3,31 @@ package gopush
 import "testing"
 
 import (
+	"bufio"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"text/template"
@@ -159,7 +174,27 @@ func postAdmin(path string, body string, t *testing.T) *http.Response {
 	return resp
 }
 
+func getService(path string, key *rsa.PrivateKey, t *testing.T) *http.Response {
+	req, err := http.NewRequest("GET", getPath(path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "GoPush "+sign("", key))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
 func postService(path string, body string, key *rsa.PrivateKey, t *testing.T) *http.Response {
+	return postServiceWithHeaders(path, body, nil, key, t)
+}
+
+func postServiceWithHeaders(path string, body string, headers map[string]string, key *rsa.PrivateKey, t *testing.T) *http.Response {
 	req, err := http.NewRequest("POST", getPath(path), strings.NewReader(body))
 	if err != nil {
 		t.Fatal(err)
@@ -167,6 +202,9 @@ func postService(path string, body string, key *rsa.PrivateKey, t *testing.T) *h
 
 	signature := sign(body, key)
 	req.Header.Set("Authorization", "GoPush "+signature)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -380,6 +418,32 @@ func TestTimeoutFunctional(t *testing.T) {
 	})
 }
 
+func TestIdleTimeout(t *testing.T) {
+	testWithServer(startTimeoutDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&lifetime=never&idletimeout=2", "test", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		// The notifications keep the center alive after the global timeout.
+		for i := 0; i < 3; i++ {
+			<-time.After(time.Second)
+			testNotificationSending(key, t, "test", true)
+		}
+
+		<-time.After(3 * time.Second)
+		testNotificationSending(key, t, "test", false)
+
+		if resp := postService("newcenter?mail=test@example.com&idletimeout=x", "test", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Invalid idle timeout is accepted, code: %d\n", resp.StatusCode)
+		}
+	})
+}
+
 func TestRedirectMainPage(t *testing.T) {
 	testWithServer(startRedirectingDummyServer, t, func(*testing.T) {
 		resp, err := http.DefaultClient.Get(getPath(""))
@@ -486,6 +550,13 @@ func TestServiceMethodAccepting(t *testing.T) {
 		testfunc("newcenter", "Notification center creation page")
 		testfunc("notify", "Notification sending page")
 		testfunc("removecenter", "Notification center removal page")
+		testfunc("presence", "Presence page")
+		testfunc("notify/batch", "Batch notification sending page")
+		testfunc("notify/broadcast", "Broadcast notification sending page")
+		testfunc("scheduled", "Scheduled notification listing page")
+		testfunc("scheduled/cancel", "Scheduled notification cancel page")
+		testfunc("report", "Delivery report page")
+		testfunc("stats", "Statistics page")
 	})
 }
 
@@ -632,6 +703,2241 @@ func TestHijackOtherUsersAccount(t *testing.T) {
 	})
 }
 
+func TestPresence(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&presence=1", "test", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		centername := getCenterName("test@example.com", "test")
+
+		// The publishers can't reach the presence center.
+		if resp := postService("newcenter?mail=test@example.com", "test____presence", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("A center takes the name of a presence center, code: %d\n", resp.StatusCode)
+		}
+
+		// The names and the options must fit in the backend.
+		if resp := postService("newcenter?mail=test@example.com", strings.Repeat("a", 256), key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("A center is created with a too long name, code: %d\n", resp.StatusCode)
+		}
+		if resp := postService("newcenter?mail=test@example.com&description="+strings.Repeat("a", 70000), "long", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("A center is created with too long options, code: %d\n", resp.StatusCode)
+		} else if b := getBody(resp); !strings.Contains(b, "too large") {
+			t.Fatalf("Unexpected error: %s\n", b)
+		}
+		for _, path := range []string{"notify?mail=test@example.com&center=test____presence", "notify?mail=test@example.com&delay=60&center=test____presence"} {
+			if resp := postService(path, "fake", key, t); resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("A notification is sent to a presence center, code: %d\n", resp.StatusCode)
+			}
+		}
+		var results []batchResult
+		if err := json.Unmarshal([]byte(getBody(postService("notify/batch?mail=test@example.com", `[{"center":"test____presence","message":"fake"}]`, key, t))), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Status != http.StatusNotFound {
+			t.Fatalf("A batch notification is sent to a presence center: %+v\n", results)
+		}
+
+		presconn, err := websocket.Dial(getRawPath("listen?center="+getPresenceCenterName(centername), "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer presconn.Close()
+
+		wsconn, err := websocket.Dial(getRawPath("listen?center="+centername+"&id=alice", "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+
+		var event presenceEvent
+		if err := websocket.JSON.Receive(presconn, &event); err != nil {
+			t.Fatal(err)
+		}
+
+		if event.Event != "join" || event.ID != "alice" || event.Listeners != 1 {
+			t.Fatalf("Invalid presence event: %+v\n", event)
+		}
+
+		resp := postService("presence?mail=test@example.com&subscribers=1", "test", key, t)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to get the presence information, code: %d\n", resp.StatusCode)
+		}
+
+		var p hubPresence
+		if err := json.Unmarshal([]byte(getBody(resp)), &p); err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Listeners != 1 || len(p.Subscribers) != 1 || p.Subscribers[0] != "alice" {
+			t.Fatalf("Invalid presence information: %+v\n", p)
+		}
+
+		if resp := postService("presence?mail=test@example.com", "missing", key, t); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Presence of a missing notification center don't send Not Found. Code: %d\n", resp.StatusCode)
+		}
+	})
+}
+
+func startUpstreamDummyServer(t *testing.T) *GoPushService {
+	config := getBaseConfig()
+	config.PrivateDestinations = true
+	return startDummyServer(config, t)
+}
+
+func TestUpstream(t *testing.T) {
+	received := make(chan *http.Request, 2)
+	bodies := make(chan []byte, 2)
+	aborted := make(chan bool, 1)
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		// The upstream hangs on this message until the request is aborted.
+		if strings.Contains(string(body), "hang") {
+			select {
+			case <-r.Context().Done():
+				aborted <- true
+			case <-time.After(30 * time.Second):
+			}
+		}
+	}))
+	defer upstreamServer.Close()
+
+	testWithServer(startUpstreamDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&upstream=unix:///tmp/gopush.sock", "test", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Unix socket upstream is accepted without enabling it. Code: %d\n", resp.StatusCode)
+		}
+
+		path := "newcenter?mail=test@example.com&upstreamsecret=secret&upstream=" + url.QueryEscape(upstreamServer.URL)
+		if resp := postService(path, "test", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		wsconn, err := websocket.Dial(getRawPath("listen?center="+getCenterName("test@example.com", "test")+"&id=alice", "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+
+		if err := websocket.Message.Send(wsconn, "ack"); err != nil {
+			t.Fatal(err)
+		}
+
+		var r *http.Request
+		var body []byte
+		select {
+		case r = <-received:
+			body = <-bodies
+		case <-time.After(5 * time.Second):
+			t.Fatal("The message is not delivered to the upstream.")
+		}
+
+		if r.Header.Get("X-GoPush-Signature") != signHMAC("secret", body) {
+			t.Fatalf("Invalid upstream signature.\n")
+		}
+
+		var m upstreamMessage
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Message != "ack" || m.Connection.ID != "alice" || m.Center != getCenterName("test@example.com", "test") {
+			t.Fatalf("Invalid upstream message: %+v\n", m)
+		}
+
+		// Removing the center does not wait for the request in progress, it is aborted.
+		if err := websocket.Message.Send(wsconn, "hang"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-received:
+			<-bodies
+		case <-time.After(5 * time.Second):
+			t.Fatal("The message is not delivered to the upstream.")
+		}
+		if resp := postService("removecenter?mail=test@example.com", "test", key, t); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to remove notification center, code: %d\n", resp.StatusCode)
+		}
+		select {
+		case <-aborted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The upstream request is not aborted when the center is removed.")
+		}
+	})
+}
+
+func TestNotifyBatch(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		centername := testNotificationCenterCreation(key, t)
+
+		resp := postService("notify/batch?mail=test@example.com", `[{"center":"`+centername+`","message":"batched"},{"center":"missing","message":"lost"}]`, key, t)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to send a batch, code: %d\n", resp.StatusCode)
+		}
+
+		var results []batchResult
+		if err := json.Unmarshal([]byte(getBody(resp)), &results); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != 2 || results[0].Status != http.StatusOK || results[1].Status != http.StatusNotFound {
+			t.Fatalf("Invalid batch results: %+v\n", results)
+		}
+
+		resp, err := http.DefaultClient.Get(getPath("ping?center=" + getCenterName("test@example.com", centername)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body := getBody(resp); body != "batched" {
+			t.Fatalf("Batched message is not delivered. Expected: 'batched', got: '%s'\n", body)
+		}
+
+		if resp := postService("notify/batch?mail=test@example.com", "not json", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Invalid batch is accepted. Code: %d\n", resp.StatusCode)
+		}
+	})
+}
+
+func TestNotifyBroadcast(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		for _, center := range []string{"news-1", "news-2", "other"} {
+			if resp := postService("newcenter?mail=test@example.com&presence=1", center, key, t); resp.StatusCode != http.StatusCreated {
+				t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+			}
+		}
+
+		wsconn, err := websocket.Dial(getRawPath("listen?center="+getCenterName("test@example.com", "news-1"), "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+
+		testfunc := func(path string, centers, listeners int) {
+			resp := postService(path, "announcement", key, t)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Failed to broadcast, code: %d\n", resp.StatusCode)
+			}
+
+			var result broadcastResult
+			if err := json.Unmarshal([]byte(getBody(resp)), &result); err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Centers != centers || result.Listeners != listeners {
+				t.Fatalf("Invalid broadcast result: %+v\n", result)
+			}
+		}
+
+		testfunc("notify/broadcast?mail=test@example.com&pattern=news-*", 2, 1)
+		testfunc("notify/broadcast?mail=test@example.com", 3, 1)
+
+		var message string
+		if err := websocket.Message.Receive(wsconn, &message); err != nil {
+			t.Fatal(err)
+		}
+
+		if message != "announcement" {
+			t.Fatalf("Broadcast is not delivered. Expected: 'announcement', got: '%s'\n", message)
+		}
+	})
+}
+
+func TestScheduledNotification(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		centername := testNotificationCenterCreation(key, t)
+
+		resp := postService("notify?mail=test@example.com&delay=1&center="+centername, "later", key, t)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Failed to schedule a notification, code: %d\n", resp.StatusCode)
+		}
+		getBody(resp)
+
+		resp = postService("notify?mail=test@example.com&delay=3600&center="+centername, "never", key, t)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Failed to schedule a notification, code: %d\n", resp.StatusCode)
+		}
+		cancelid := getBody(resp)
+
+		resp = postService("scheduled?mail=test@example.com", "", key, t)
+		var list []ScheduledNotification
+		if err := json.Unmarshal([]byte(getBody(resp)), &list); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list) != 2 || list[1].ID != cancelid {
+			t.Fatalf("Invalid list of scheduled notifications: %+v\n", list)
+		}
+
+		// The notifications of a user are not seen by the others. testAdminAdd always adds test@example.com.
+		page := getAdminMainPage(t)
+		otherkey := stringToPrivateKey(getBody(postAdmin("admin/add", fmt.Sprintf("mail=other@example.com&publickey=&nonce=%s&formid=%s", page.Nonce, page.FormID), t)))
+		if otherkey == nil {
+			t.Fatal("Invalid key")
+		}
+		if body := getBody(postService("scheduled?mail=other@example.com", "", otherkey, t)); body != "[]" {
+			t.Fatalf("Invalid list of scheduled notifications of another user: %s\n", body)
+		}
+		if resp := postService("scheduled/cancel?mail=other@example.com", cancelid, otherkey, t); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Another user cancelled a scheduled notification, code: %d\n", resp.StatusCode)
+		}
+
+		if resp := postService("scheduled/cancel?mail=test@example.com", cancelid, key, t); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to cancel a scheduled notification, code: %d\n", resp.StatusCode)
+		}
+
+		if resp := postService("scheduled/cancel?mail=test@example.com", cancelid, key, t); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Cancelled notification is still pending, code: %d\n", resp.StatusCode)
+		}
+
+		<-time.After(2 * time.Second)
+
+		resp, err := http.DefaultClient.Get(getPath("ping?center=" + getCenterName("test@example.com", centername)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body := getBody(resp); body != "later" {
+			t.Fatalf("Scheduled notification is not delivered. Expected: 'later', got: '%s'\n", body)
+		}
+
+		if resp := postService("notify?mail=test@example.com&delay=x&center="+centername, "invalid", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Invalid delay is accepted, code: %d\n", resp.StatusCode)
+		}
+	})
+}
+
+func TestMessageTTL(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&default=idle&tombstone=1", "test", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		centername := getCenterName("test@example.com", "test")
+
+		wsconn, err := websocket.Dial(getRawPath("listen?center="+centername, "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+
+		if resp := postService("notify?mail=test@example.com&center=test&ttl=1", "deploying", key, t); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to send a notification, code: %d\n", resp.StatusCode)
+		}
+
+		for _, expected := range []string{"deploying", "idle"} {
+			var message string
+			if err := websocket.Message.Receive(wsconn, &message); err != nil {
+				t.Fatal(err)
+			}
+
+			if message != expected {
+				t.Fatalf("Invalid message. Expected: '%s', got: '%s'\n", expected, message)
+			}
+		}
+
+		resp, err := http.DefaultClient.Get(getPath("ping?center=" + centername))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body := getBody(resp); body != "idle" {
+			t.Fatalf("The state is not reverted to the default. Got: '%s'\n", body)
+		}
+
+		if resp := postService("notify?mail=test@example.com&center=test&ttl=-1", "invalid", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Invalid TTL is accepted, code: %d\n", resp.StatusCode)
+		}
+	})
+}
+
+func TestIdempotentNotification(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		centername := testNotificationCenterCreation(key, t)
+
+		wsconn, err := websocket.Dial(getRawPath("listen?center="+getCenterName("test@example.com", centername), "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+
+		headers := map[string]string{"Idempotency-Key": "retry-1"}
+
+		resp := postServiceWithHeaders("notify?mail=test@example.com&center="+centername, "first", headers, key, t)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+			t.Fatalf("Failed to send a notification, code: %d\n", resp.StatusCode)
+		}
+
+		resp = postServiceWithHeaders("notify?mail=test@example.com&center="+centername, "first", headers, key, t)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("The retry is not replayed, code: %d\n", resp.StatusCode)
+		}
+
+		testNotificationSending(key, t, centername, true)
+
+		for _, expected := range []string{"first", ""} {
+			var message string
+			if err := websocket.Message.Receive(wsconn, &message); err != nil {
+				t.Fatal(err)
+			}
+
+			if expected != "" && message != expected {
+				t.Fatalf("Invalid message. Expected: '%s', got: '%s'\n", expected, message)
+			}
+
+			if expected == "" && message == "first" {
+				t.Fatalf("The retried notification is broadcasted again.\n")
+			}
+		}
+	})
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	svc := &GoPushService{}
+	c := &notificationCenter{}
+
+	handler := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	}
+	svc.handleIdempotent(httptest.NewRecorder(), c, "key", handler)
+
+	replay := httptest.NewRecorder()
+	svc.handleIdempotent(replay, c, "key", func(w http.ResponseWriter) {
+		t.Fatal("The handler runs again.")
+	})
+	if replay.Code != http.StatusCreated || replay.Body.String() != "{}" || replay.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Fatalf("Invalid replayed response: %d %v %s\n", replay.Code, replay.Header(), replay.Body.String())
+	}
+
+	// A panicking handler releases the key for the retries.
+	func() {
+		defer func() { recover() }()
+		svc.handleIdempotent(httptest.NewRecorder(), c, "panic", func(w http.ResponseWriter) {
+			panic("failure")
+		})
+	}()
+	ran := false
+	svc.handleIdempotent(httptest.NewRecorder(), c, "panic", func(w http.ResponseWriter) {
+		ran = true
+	})
+	if !ran {
+		t.Fatal("The retry after a panic is not run.")
+	}
+}
+
+func TestDeliveryReport(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		centername := testNotificationCenterCreation(key, t)
+
+		wsconn, err := websocket.Dial(getRawPath("listen?ack=1&center="+getCenterName("test@example.com", centername), "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+
+		resp := postService("notify?mail=test@example.com&center="+centername, "critical", key, t)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to send a notification, code: %d\n", resp.StatusCode)
+		}
+		id := getBody(resp)
+
+		var envelope ackEnvelope
+		if err := websocket.JSON.Receive(wsconn, &envelope); err != nil {
+			t.Fatal(err)
+		}
+
+		if envelope.ID != id || envelope.Message != "critical" {
+			t.Fatalf("Invalid message envelope: %+v\n", envelope)
+		}
+
+		// A repeated acknowledgement, and one from a connection which did not get the message, are not counted.
+		for i := 0; i < 2; i++ {
+			if err := websocket.JSON.Send(wsconn, ackFrame{Ack: id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		other, err := websocket.Dial(getRawPath("listen?ack=1&center="+getCenterName("test@example.com", centername), "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		if err := websocket.JSON.Send(other, ackFrame{Ack: id}); err != nil {
+			t.Fatal(err)
+		}
+
+		<-time.After(100 * time.Millisecond)
+
+		resp = postService("report?mail=test@example.com", id, key, t)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to get the delivery report, code: %d\n", resp.StatusCode)
+		}
+
+		var report deliveryReportData
+		if err := json.Unmarshal([]byte(getBody(resp)), &report); err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Recipients != 1 || report.Delivered != 1 || report.Acked != 1 || report.Dropped != 0 {
+			t.Fatalf("Invalid delivery report: %+v\n", report)
+		}
+
+		if resp := postService("report?mail=test@example.com", "missing", key, t); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Report of a missing message don't send Not Found. Code: %d\n", resp.StatusCode)
+		}
+	})
+}
+
+func TestDeliveryReportRetention(t *testing.T) {
+	reports := newDeliveryReports(60)
+	old := reports.create("test@example.com", "test")
+	old.time -= 120
+	recent := reports.create("test@example.com", "test")
+	if reports.get(old.id) != nil || reports.get(recent.id) != recent {
+		t.Fatal("The expired reports are kept")
+	}
+
+	// The internal subscribers are not recipients.
+	h := newWSHub(16)
+	h.connections[&wsconnection{send: make(chan *hubMessage, 1), hub: h}] = true
+	h.connections[&wsconnection{send: make(chan *hubMessage, 1), hub: h, internal: true}] = true
+	m := &hubMessage{data: "test", report: recent}
+	h.send(m)
+	if recent.snapshot().Recipients != 1 {
+		t.Fatalf("Invalid delivery report: %+v\n", recent.snapshot())
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	testfunc := func(policy string, expected []string) {
+		h := newWSHub(16)
+		h.policy = policy
+		c := &wsconnection{send: make(chan *hubMessage, 2), hub: h}
+		h.connections[c] = true
+
+		for _, data := range []string{"a", "b", "c"} {
+			h.deliver(c, &hubMessage{data: data})
+		}
+
+		var got []string
+		for len(c.send) > 0 {
+			got = append(got, (<-c.send).data)
+		}
+
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Fatalf("Invalid buffer with the %s policy. Expected: %v, got: %v\n", policy, expected, got)
+		}
+	}
+
+	testfunc(policyDropOldest, []string{"b", "c"})
+	testfunc(policyCoalesce, []string{"c"})
+}
+
+func TestSlowConsumerStats(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&policy=invalid", "test", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Invalid policy is accepted, code: %d\n", resp.StatusCode)
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&policy=coalesce&sendbuffer=16", "test", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		resp := postService("stats?mail=test@example.com", "test", key, t)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to get the statistics, code: %d\n", resp.StatusCode)
+		}
+
+		var stats slowConsumerStats
+		if err := json.Unmarshal([]byte(getBody(resp)), &stats); err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.Policy != policyCoalesce || stats.SendBuffer != 16 {
+			t.Fatalf("Invalid statistics: %+v\n", stats)
+		}
+	})
+}
+
+func startKeepaliveDummyServer(t *testing.T) *GoPushService {
+	config := getBaseConfig()
+	config.PingInterval = 1
+	config.ReadTimeout = 2
+	return startDummyServer(config, t)
+}
+
+func TestKeepaliveConfig(t *testing.T) {
+	for _, c := range []struct{ ping, read, expected int64 }{{0, 0, 0}, {5, 0, 5}, {5, 10, 5}, {0, 10, 5}, {10, 10, 5}, {0, 1, 1}} {
+		config := checkKeepalive(Config{PingInterval: c.ping, ReadTimeout: c.read})
+		if config.PingInterval != c.expected || config.ReadTimeout != c.read {
+			t.Fatalf("Invalid ping interval for %+v: %d\n", c, config.PingInterval)
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	testWithServer(startKeepaliveDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		centername := testNotificationCenterCreation(key, t)
+
+		hbconn, err := websocket.Dial(getRawPath("listen?heartbeat=1&center="+getCenterName("test@example.com", centername), "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer hbconn.Close()
+
+		var message string
+		if err := websocket.Message.Receive(hbconn, &message); err != nil {
+			t.Fatal(err)
+		}
+
+		if message != heartbeatMessage {
+			t.Fatalf("Invalid heartbeat message: '%s'\n", message)
+		}
+
+		hbconn.Close()
+
+		// This client answers the pings while it reads.
+		liveconn, err := websocket.Dial(getRawPath("listen?center="+getCenterName("test@example.com", centername), "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer liveconn.Close()
+		go func() {
+			var message string
+			for websocket.Message.Receive(liveconn, &message) == nil {
+			}
+		}()
+
+		// This client never reads, so it never answers the pings.
+		deadconn, err := websocket.Dial(getRawPath("listen?center="+getCenterName("test@example.com", centername), "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer deadconn.Close()
+
+		<-time.After(4 * time.Second)
+
+		resp := postService("presence?mail=test@example.com", centername, key, t)
+		var p hubPresence
+		if err := json.Unmarshal([]byte(getBody(resp)), &p); err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Listeners != 1 {
+			t.Fatalf("Dead connection is not dropped, or live connection is dropped. Listeners: %d\n", p.Listeners)
+		}
+	})
+}
+
+func TestSTOMPKeepalive(t *testing.T) {
+	testWithServer(startKeepaliveDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		centername := testNotificationCenterCreation(key, t)
+		center := getCenterName("test@example.com", centername)
+
+		// Returns the heart-beat header of the server. The subscriber only reads, it sends no heartbeats.
+		subscribe := func(heartbeat string) string {
+			config, err := websocket.NewConfig(getRawPath("listen", "ws"), getPath(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Protocol = []string{stompProtocol}
+			wsconn, err := websocket.DialConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			websocket.Message.Send(wsconn, "CONNECT\naccept-version:1.2\nheart-beat:"+heartbeat+"\n\n\x00")
+			r := bufio.NewReader(wsconn)
+			f, err := readSTOMPFrame(r, stompMaxFrameSize)
+			if err != nil || f.command != "CONNECTED" {
+				t.Fatalf("Failed to connect: %v\n", err)
+			}
+			websocket.Message.Send(wsconn, "SUBSCRIBE\nid:0\ndestination:/center/"+center+"\n\n\x00")
+
+			go func() {
+				defer wsconn.Close()
+				for {
+					if _, err := readSTOMPFrame(r, stompMaxFrameSize); err != nil {
+						return
+					}
+				}
+			}()
+
+			return f.header("heart-beat")
+		}
+
+		// The client can't keep the connection alive with its heartbeats, so the service sends ping frames.
+		for heartbeat, expected := range map[string]string{"0,0": "0,0", "0,500": "0,0", "5000,500": "0,5000"} {
+			if got := subscribe(heartbeat); got != expected {
+				t.Fatalf("Invalid heart-beat header for %s. Expected: %s, got: %s\n", heartbeat, expected, got)
+			}
+		}
+
+		<-time.After(4 * time.Second)
+
+		resp := postService("presence?mail=test@example.com", centername, key, t)
+		var p hubPresence
+		if err := json.Unmarshal([]byte(getBody(resp)), &p); err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Listeners != 3 {
+			t.Fatalf("Idle STOMP subscribers are dropped. Listeners: %d\n", p.Listeners)
+		}
+	})
+}
+
+func TestListCenters(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&presence=1&description=Dashboard", "b", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		if resp := postService("newcenter?mail=test@example.com", "a", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		testNotificationSending(key, t, "b", true)
+
+		resp := getService("centers?mail=test@example.com", key, t)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to list the notification centers, code: %d\n", resp.StatusCode)
+		}
+
+		var list []centerInfo
+		if err := json.Unmarshal([]byte(getBody(resp)), &list); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list) != 2 || list[0].Center != "a" || list[1].Center != "b" {
+			t.Fatalf("Invalid list of notification centers: %+v\n", list)
+		}
+
+		if list[1].Description != "Dashboard" || list[1].Creator != "test@example.com" || list[1].Created == 0 || list[1].LastNotify == 0 || list[0].LastNotify != 0 {
+			t.Fatalf("Invalid notification center metadata: %+v\n", list[1])
+		}
+
+		if resp := postService("centers?mail=test@example.com", "", key, t); resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("POST is allowed on the notification center list, code: %d\n", resp.StatusCode)
+		}
+	})
+}
+
+func TestOpaqueCenterName(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		resp := postService("newcenter?mail=test@example.com&opaque=1", "test", key, t)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		centername := getBody(resp)
+		if strings.Contains(centername, "test@example.com") || centername == "" {
+			t.Fatalf("The name of the notification center is not opaque: '%s'\n", centername)
+		}
+
+		testmsg := testNotificationSending(key, t, "test", true)
+
+		resp, err := http.DefaultClient.Get(getPath("ping?center=" + centername))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body := getBody(resp); body != testmsg {
+			t.Fatalf("Message retrieval through the opaque name is failed. Expected: '%s', got: '%s'\n", testmsg, body)
+		}
+
+		resp, err = http.DefaultClient.Get(getPath("ping?center=" + getCenterName("test@example.com", "test")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("The notification center is reachable by its guessable name, code: %d\n", resp.StatusCode)
+		}
+
+		if resp := postService("removecenter?mail=test@example.com", "test", key, t); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to remove notification center, code: %d\n", resp.StatusCode)
+		}
+
+		testNotificationSending(key, t, "test", false)
+	})
+}
+
+func TestPersistentCenters(t *testing.T) {
+	backend := NewDummyBackend()
+	startfunc := func(t *testing.T) *GoPushService {
+		return startServer(getBaseConfig(), backend, t)
+	}
+
+	var centername, removed, testmsg string
+
+	testWithServer(startfunc, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		centername = testNotificationCenterCreation(key, t)
+		testmsg = testNotificationSending(key, t, centername, true)
+
+		if resp := postService("newcenter?mail=test@example.com&default=gone", "expiring", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		if resp := postService("notify?mail=test@example.com&center=expiring&ttl=1", "state", key, t); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to send a notification, code: %d\n", resp.StatusCode)
+		}
+
+		removed = testNotificationCenterCreation(key, t)
+		testNotificationCenterRemoval(key, t, removed)
+	})
+
+	testWithServer(startfunc, t, func(t *testing.T) {
+		testfunc := func(center string, code int, expected string) {
+			resp, err := http.DefaultClient.Get(getPath("ping?center=" + getCenterName("test@example.com", center)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := getBody(resp)
+			if resp.StatusCode != code {
+				t.Fatalf("Invalid status code for the restored center '%s'. Expected: %d, got: %d\n", center, code, resp.StatusCode)
+			}
+			if code == http.StatusOK && body != expected {
+				t.Fatalf("Invalid restored state of '%s'. Expected: '%s', got: '%s'\n", center, expected, body)
+			}
+		}
+
+		testfunc(centername, http.StatusOK, testmsg)
+		testfunc("expiring", http.StatusOK, "gone")
+		testfunc(removed, http.StatusNotFound, "")
+	})
+}
+
+func TestDocumentCenter(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&document=xml", "doc", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Invalid document format is accepted, code: %d\n", resp.StatusCode)
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&document=merge&default="+url.QueryEscape(`{"a":1}`), "doc", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		centername := getCenterName("test@example.com", "doc")
+		listen := func(query string) *websocket.Conn {
+			wsconn, err := websocket.Dial(getRawPath("listen?center="+centername+query, "ws"), "", getPath(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return wsconn
+		}
+
+		full := listen("")
+		defer full.Close()
+		patches := listen("&patches=1")
+		defer patches.Close()
+		<-time.After(100 * time.Millisecond)
+
+		notify := func(center, patch string, code int) {
+			if resp := postService("notify?mail=test@example.com&center="+center, patch, key, t); resp.StatusCode != code {
+				t.Fatalf("Invalid status code of the patch '%s'. Expected: %d, got: %d\n", patch, code, resp.StatusCode)
+			}
+		}
+		expect := func(wsconn *websocket.Conn, expected string) {
+			var message string
+			wsconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := websocket.Message.Receive(wsconn, &message); err != nil {
+				t.Fatal(err)
+			}
+			if message != expected {
+				t.Fatalf("Invalid message. Expected: '%s', got: '%s'\n", expected, message)
+			}
+		}
+		ping := func(center, expected string) {
+			resp, err := http.DefaultClient.Get(getPath("ping?center=" + getCenterName("test@example.com", center)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body := getBody(resp); body != expected {
+				t.Fatalf("Invalid document. Expected: '%s', got: '%s'\n", expected, body)
+			}
+		}
+
+		notify("doc", `{"b":{"c":2}}`, http.StatusOK)
+		expect(full, `{"a":1,"b":{"c":2}}`)
+		expect(patches, `{"b":{"c":2}}`)
+
+		notify("doc", `{"a":null,"b":{"d":3}}`, http.StatusOK)
+		expect(full, `{"b":{"c":2,"d":3}}`)
+		expect(patches, `{"a":null,"b":{"d":3}}`)
+
+		notify("doc", "not json", http.StatusBadRequest)
+		ping("doc", `{"b":{"c":2,"d":3}}`)
+
+		if resp := postService("newcenter?mail=test@example.com&document=jsonpatch", "list", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		notify("list", `[{"op":"add","path":"/list","value":[1]},{"op":"add","path":"/list/-","value":2}]`, http.StatusOK)
+		ping("list", `{"list":[1,2]}`)
+
+		notify("list", `[{"op":"remove","path":"/list/0"},{"op":"test","path":"/list/0","value":3}]`, http.StatusBadRequest)
+		ping("list", `{"list":[1,2]}`)
+	})
+}
+
+func TestSendState(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&sendstate=1&default=initial", "state", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		if resp := postService("newcenter?mail=test@example.com", "plain", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		listen := func(center, query string) *websocket.Conn {
+			wsconn, err := websocket.Dial(getRawPath("listen?center="+getCenterName("test@example.com", center)+query, "ws"), "", getPath(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wsconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			return wsconn
+		}
+		receive := func(wsconn *websocket.Conn) string {
+			var message string
+			if err := websocket.Message.Receive(wsconn, &message); err != nil {
+				t.Fatal(err)
+			}
+			return message
+		}
+
+		wsconn := listen("state", "")
+		if message := receive(wsconn); message != "initial" {
+			t.Fatalf("Invalid initial state. Expected: 'initial', got: '%s'\n", message)
+		}
+		wsconn.Close()
+
+		testmsg := testNotificationSending(key, t, "state", true)
+		wsconn = listen("state", "")
+		if message := receive(wsconn); message != testmsg {
+			t.Fatalf("Invalid initial state. Expected: '%s', got: '%s'\n", testmsg, message)
+		}
+		wsconn.Close()
+
+		// Without the option, the first message is the next notification.
+		wsconn = listen("plain", "")
+		<-time.After(100 * time.Millisecond)
+		testmsg = testNotificationSending(key, t, "plain", true)
+		if message := receive(wsconn); message != testmsg {
+			t.Fatalf("Invalid first message. Expected: '%s', got: '%s'\n", testmsg, message)
+		}
+		wsconn.Close()
+
+		// The state is never older than the first broadcast, and nothing is missed after it.
+		done := make(chan bool)
+		go func() {
+			for i := 1; i <= 20; i++ {
+				postService("notify?mail=test@example.com&center=plain", fmt.Sprintf("%d", i), key, t)
+			}
+			done <- true
+		}()
+
+		wsconn = listen("plain", "&state=1")
+		defer wsconn.Close()
+		previous := -1
+		for previous != 20 {
+			var current int
+			message := receive(wsconn)
+			if previous == -1 && message == testmsg {
+				previous = 0
+				continue
+			}
+			if _, err := fmt.Sscanf(message, "%d", &current); err != nil {
+				t.Fatalf("Invalid message: '%s'\n", message)
+			}
+			if previous != -1 && current != previous+1 {
+				t.Fatalf("Messages are missing or out of order. Expected: %d, got: %d\n", previous+1, current)
+			}
+			previous = current
+		}
+		<-done
+	})
+}
+
+// Opens a websocket connection without the websocket package, to see the frames as they are.
+func dialRawWebsocket(path string, t *testing.T) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(conn, "GET /%s HTTP/1.1\r\nHost: localhost:%d\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nOrigin: %s\r\n\r\n", path, port, getPath(""))
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Failed to open the websocket, code: %d\n", resp.StatusCode)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	return conn, r
+}
+
+// Reads the frames until the close frame, and returns its code and reason.
+func readCloseFrame(r *bufio.Reader, t *testing.T) (int, string) {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			t.Fatal(err)
+		}
+
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			extended := make([]byte, 2)
+			if _, err := io.ReadFull(r, extended); err != nil {
+				t.Fatal(err)
+			}
+			length = uint64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended := make([]byte, 8)
+			if _, err := io.ReadFull(r, extended); err != nil {
+				t.Fatal(err)
+			}
+			length = binary.BigEndian.Uint64(extended)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if header[0]&0x0f == websocket.CloseFrame {
+			if len(payload) < 2 {
+				return 0, ""
+			}
+			return int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+		}
+	}
+}
+
+func TestCloseCodes(t *testing.T) {
+	testfunc := func(r *bufio.Reader, code int, reason string) {
+		c, rs := readCloseFrame(r, t)
+		if c != code || rs != reason {
+			t.Fatalf("Invalid close frame. Expected: %d '%s', got: %d '%s'\n", code, reason, c, rs)
+		}
+	}
+
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		conn, r := dialRawWebsocket("listen?center=missing", t)
+		defer conn.Close()
+		testfunc(r, closeUnknownCenter, "unknown notification center")
+
+		centername := testNotificationCenterCreation(key, t)
+		conn, r = dialRawWebsocket("listen?center="+getCenterName("test@example.com", centername), t)
+		defer conn.Close()
+		<-time.After(100 * time.Millisecond)
+		testNotificationCenterRemoval(key, t, centername)
+		testfunc(r, closeCenterRemoved, "notification center removed")
+
+		if resp := postService("newcenter?mail=test@example.com&lifetime=1", "expiring", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		conn, r = dialRawWebsocket("listen?center="+getCenterName("test@example.com", "expiring"), t)
+		defer conn.Close()
+		testfunc(r, closeCenterExpired, "notification center expired")
+
+		// The test client is not on the page of the allowed origin.
+		if resp := postService("newcenter?mail=test@example.com&listenorigin="+url.QueryEscape("https://app.example.com"), "restricted", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		conn, r = dialRawWebsocket("listen?center="+getCenterName("test@example.com", "restricted"), t)
+		defer conn.Close()
+		testfunc(r, closeUnauthorized, "unauthorized")
+	})
+
+	svc := startBasicDummyServer(t)
+	defer func() { port++ }()
+	<-time.After(time.Second)
+
+	key := testAdminAdd("test@example.com", t)
+	if key == nil {
+		t.Fatal("Invalid key")
+	}
+	centername := testNotificationCenterCreation(key, t)
+	conn, r := dialRawWebsocket("listen?center="+getCenterName("test@example.com", centername), t)
+	defer conn.Close()
+	<-time.After(100 * time.Millisecond)
+
+	svc.Stop()
+	testfunc(r, closeGoingAway, "server shutting down")
+}
+
+func TestMultiplexedListen(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&sendstate=1&default=initial", "first", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		if resp := postService("newcenter?mail=test@example.com", "second", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		if resp := postService("newcenter?mail=test@example.com&listenorigin="+url.QueryEscape("https://app.example.com"), "restricted", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		first := getCenterName("test@example.com", "first")
+		second := getCenterName("test@example.com", "second")
+
+		config, err := websocket.NewConfig(getRawPath("listen", "ws"), getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Protocol = []string{"unknown", muxProtocol}
+		wsconn, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+		wsconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		send := func(frame string) {
+			if err := websocket.Message.Send(wsconn, frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect := func(expected muxResponse) {
+			var r muxResponse
+			if err := websocket.JSON.Receive(wsconn, &r); err != nil {
+				t.Fatal(err)
+			}
+			if expected.Message != nil && (r.Message == nil || *r.Message != *expected.Message) {
+				t.Fatalf("Invalid message. Expected: %+v, got: %+v\n", expected, r)
+			}
+			r.Message, expected.Message = nil, nil
+			if r != expected {
+				t.Fatalf("Invalid frame. Expected: %+v, got: %+v\n", expected, r)
+			}
+		}
+		message := func(m string) *string {
+			return &m
+		}
+
+		send(`{"action":"subscribe","center":"` + first + `"}`)
+		expect(muxResponse{Center: first, Event: "subscribed"})
+		expect(muxResponse{Center: first, Message: message("initial")})
+
+		send(`{"action":"subscribe","center":"` + second + `"}`)
+		expect(muxResponse{Center: second, Event: "subscribed"})
+
+		send(`{"action":"subscribe","center":"missing"}`)
+		expect(muxResponse{Center: "missing", Event: "error", Code: closeUnknownCenter, Reason: "unknown notification center"})
+
+		restricted := getCenterName("test@example.com", "restricted")
+		send(`{"action":"subscribe","center":"` + restricted + `"}`)
+		expect(muxResponse{Center: restricted, Event: "error", Code: closeUnauthorized, Reason: "unauthorized"})
+
+		testmsg := testNotificationSending(key, t, "second", true)
+		expect(muxResponse{Center: second, Message: &testmsg})
+		testmsg = testNotificationSending(key, t, "first", true)
+		expect(muxResponse{Center: first, Message: &testmsg})
+
+		send(`{"action":"unsubscribe","center":"` + first + `"}`)
+		expect(muxResponse{Center: first, Event: "unsubscribed"})
+		testNotificationSending(key, t, "first", true)
+
+		testNotificationCenterRemoval(key, t, "second")
+		expect(muxResponse{Center: second, Event: "unsubscribed", Code: closeCenterRemoved, Reason: "notification center removed"})
+	})
+}
+
+func TestMQTT(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&default=retained", "mqtt", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		topic := getCenterName("test@example.com", "mqtt")
+
+		config, err := websocket.NewConfig(getRawPath("mqtt", "ws"), getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Protocol = []string{mqttProtocol}
+		wsconn, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+		wsconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(wsconn)
+
+		send := func(kind, flags byte, body []byte) {
+			if err := websocket.Message.Send(wsconn, encodeMQTTPacket(kind, flags, body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect := func(kind, flags byte, body []byte) {
+			p, err := readMQTTPacket(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.kind != kind || p.flags != flags || string(p.body) != string(body) {
+				t.Fatalf("Invalid packet. Expected: %d %d %q, got: %d %d %q\n", kind, flags, body, p.kind, p.flags, p.body)
+			}
+		}
+		publish := func(message string) []byte {
+			return append(appendMQTTString(nil, topic), message...)
+		}
+
+		connect := appendMQTTString(nil, "MQTT")
+		connect = append(connect, 4, mqttConnectFlagCleanSession, 0, 60)
+		connect = appendMQTTString(connect, "client")
+		send(mqttConnect, 0, connect)
+		expect(mqttConnack, 0, []byte{0, mqttAccepted})
+
+		subscribe := append(mqttPacketID(1), appendMQTTString(nil, topic)...)
+		subscribe = append(subscribe, 0)
+		subscribe = append(appendMQTTString(subscribe, "missing"), 0)
+		send(mqttSubscribe, 2, subscribe)
+		expect(mqttSuback, 0, []byte{0, 1, 0, mqttSubscriptionFailure})
+		expect(mqttPublish, 1, publish("retained"))
+
+		testmsg := testNotificationSending(key, t, "mqtt", true)
+		expect(mqttPublish, 0, publish(testmsg))
+
+		send(mqttPingreq, 0, nil)
+		expect(mqttPingresp, 0, nil)
+
+		// A repeated subscription gets the retained message again.
+		send(mqttSubscribe, 2, append(append(mqttPacketID(3), appendMQTTString(nil, topic)...), 0))
+		expect(mqttSuback, 0, []byte{0, 3, 0})
+		expect(mqttPublish, 1, publish(testmsg))
+
+		send(mqttUnsubscribe, 2, append(mqttPacketID(2), appendMQTTString(nil, topic)...))
+		expect(mqttUnsuback, 0, mqttPacketID(2))
+
+		send(mqttDisconnect, 0, nil)
+	})
+}
+
+func TestMQTTKeepalive(t *testing.T) {
+	testWithServer(startKeepaliveDummyServer, t, func(t *testing.T) {
+		config, err := websocket.NewConfig(getRawPath("mqtt", "ws"), getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Protocol = []string{mqttProtocol}
+		wsconn, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+
+		// The client answers the pings while it reads, but it sends no packets within its keepalive of 1 second.
+		connect := appendMQTTString(nil, "MQTT")
+		connect = append(connect, 4, mqttConnectFlagCleanSession, 0, 1)
+		connect = appendMQTTString(connect, "client")
+		if err := websocket.Message.Send(wsconn, encodeMQTTPacket(mqttConnect, 0, connect)); err != nil {
+			t.Fatal(err)
+		}
+
+		wsconn.SetReadDeadline(time.Now().Add(4 * time.Second))
+		var message []byte
+		for {
+			if err := websocket.Message.Receive(wsconn, &message); err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					t.Fatal("The keepalive of the client is not enforced.")
+				}
+				break
+			}
+		}
+	})
+}
+
+func TestSTOMP(t *testing.T) {
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com", "stomp", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		center := getCenterName("test@example.com", "stomp")
+
+		config, err := websocket.NewConfig(getRawPath("listen", "ws"), getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Protocol = []string{"v10.stomp", stompProtocol}
+		wsconn, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+		wsconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(wsconn)
+
+		send := func(frame string) {
+			if err := websocket.Message.Send(wsconn, frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect := func(command string, headers map[string]string) *stompFrame {
+			f, err := readSTOMPFrame(r, stompMaxFrameSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.command != command {
+				t.Fatalf("Invalid frame. Expected: %s, got: %s %v\n", command, f.command, f.headers)
+			}
+			for name, value := range headers {
+				if f.header(name) != value {
+					t.Fatalf("Invalid %s header. Expected: %s, got: %s\n", name, value, f.header(name))
+				}
+			}
+			return f
+		}
+
+		send("CONNECT\naccept-version:1.2\nhost:localhost\n\n\x00")
+		expect("CONNECTED", map[string]string{"version": "1.2"})
+
+		send("SUBSCRIBE\nid:0\ndestination:/center/" + center + "\nreceipt:1\n\n\x00")
+		expect("RECEIPT", map[string]string{"receipt-id": "1"})
+
+		testmsg := testNotificationSending(key, t, "stomp", true)
+		f := expect("MESSAGE", map[string]string{
+			"subscription": "0",
+			"destination":  "/center/" + center,
+			"content-type": "text/plain;charset=utf-8",
+		})
+		if f.body != testmsg || f.header("message-id") == "" {
+			t.Fatalf("Invalid message. Expected: %s, got: %s %v\n", testmsg, f.body, f.headers)
+		}
+
+		send("UNSUBSCRIBE\nid:0\nreceipt:2\n\n\x00")
+		expect("RECEIPT", map[string]string{"receipt-id": "2"})
+
+		send("SUBSCRIBE\nid:1\ndestination:/center/missing\n\n\x00")
+		expect("ERROR", map[string]string{"message": closeReasons[closeUnknownCenter]})
+	})
+}
+
+func startWebhookDummyServer(t *testing.T) *GoPushService {
+	config := getBaseConfig()
+	config.WebhookMaxAttempts = 2
+	config.WebhookRetryDelay = 1
+	config.PrivateDestinations = true
+	return startDummyServer(config, t)
+}
+
+func TestWebhooks(t *testing.T) {
+	requests := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+	attempts := 0
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		requests <- r
+		bodies <- body
+	}))
+	defer hookServer.Close()
+
+	deadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer deadServer.Close()
+
+	testWithServer(startWebhookDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		center := testNotificationCenterCreation(key, t)
+
+		if resp := postService("webhooks/add?mail=test@example.com&url=ftp://example.com/", center, key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Invalid webhook URL is accepted. Code: %d\n", resp.StatusCode)
+		}
+
+		addWebhook := func(destination string) string {
+			resp := postService("webhooks/add?mail=test@example.com&secret=secret&url="+url.QueryEscape(destination), center, key, t)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("Failed to add webhook, code: %d\n", resp.StatusCode)
+			}
+			var created map[string]string
+			if err := json.Unmarshal([]byte(getBody(resp)), &created); err != nil {
+				t.Fatal(err)
+			}
+			if created["id"] == "" || created["secret"] != "secret" {
+				t.Fatalf("Invalid webhook: %v\n", created)
+			}
+			return created["id"]
+		}
+		hookID := addWebhook(hookServer.URL)
+		deadID := addWebhook(deadServer.URL)
+
+		// The webhooks are not listeners.
+		var p hubPresence
+		if err := json.Unmarshal([]byte(getBody(postService("presence?mail=test@example.com&subscribers=1", center, key, t))), &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Listeners != 0 || len(p.Subscribers) != 0 {
+			t.Fatalf("Webhooks show up in the presence information: %+v\n", p)
+		}
+
+		testmsg := testNotificationSending(key, t, center, true)
+
+		var r *http.Request
+		var body []byte
+		select {
+		case r = <-requests:
+			body = <-bodies
+		case <-time.After(5 * time.Second):
+			t.Fatal("The message is not delivered to the webhook.")
+		}
+
+		if r.Header.Get("X-GoPush-Signature") != signHMAC("secret", body) {
+			t.Fatalf("Invalid webhook signature.\n")
+		}
+		if r.Header.Get("X-GoPush-Webhook") != hookID || r.Header.Get("X-GoPush-Attempt") != "2" {
+			t.Fatalf("Invalid webhook headers: %v\n", r.Header)
+		}
+
+		var m webhookMessage
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Message != testmsg || m.Center != getCenterName("test@example.com", center) || m.ID == "" {
+			t.Fatalf("Invalid webhook message: %+v\n", m)
+		}
+
+		var list []webhookStatus
+		for i := 0; i < 50; i++ {
+			resp := postService("webhooks?mail=test@example.com&deadletters=1", center, key, t)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Failed to list webhooks, code: %d\n", resp.StatusCode)
+			}
+			if err := json.Unmarshal([]byte(getBody(resp)), &list); err != nil {
+				t.Fatal(err)
+			}
+			if len(list) == 2 && list[1].DeadLettered == 1 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if len(list) != 2 || list[0].ID != hookID || list[0].Delivered != 1 || list[0].Failed != 1 || list[0].LastStatus != http.StatusOK {
+			t.Fatalf("Invalid webhook status: %+v\n", list)
+		}
+		if list[1].ID != deadID || list[1].DeadLettered != 1 || list[1].Failed != 2 || len(list[1].DeadLetters) != 1 ||
+			list[1].DeadLetters[0].Message != testmsg || list[1].LastStatus != http.StatusServiceUnavailable {
+			t.Fatalf("Invalid dead letters: %+v\n", list[1])
+		}
+
+		if resp := postService("webhooks/remove?mail=test@example.com&id="+deadID, center, key, t); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to remove webhook, code: %d\n", resp.StatusCode)
+		}
+		if resp := postService("webhooks/remove?mail=test@example.com&id="+deadID, center, key, t); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Removed webhook is removed again, code: %d\n", resp.StatusCode)
+		}
+
+		resp := postService("webhooks?mail=test@example.com", center, key, t)
+		if err := json.Unmarshal([]byte(getBody(resp)), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].ID != hookID {
+			t.Fatalf("Invalid webhooks after removal: %+v\n", list)
+		}
+	})
+}
+
+func startWebPushDummyServer(t *testing.T) *GoPushService {
+	config := getBaseConfig()
+	config.WebPushInsecureEndpoints = true
+	config.PrivateDestinations = true
+	config.VAPIDSubject = "mailto:test@example.com"
+	return startDummyServer(config, t)
+}
+
+// Decrypts a Web Push message like a browser does.
+func decryptWebPush(body []byte, uaPrivate *ecdh.PrivateKey, auth []byte) ([]byte, error) {
+	if len(body) < webPushHeaderSize {
+		return nil, errors.New("short body")
+	}
+
+	salt := body[:16]
+	keyLength := int(body[20])
+	asPublic := body[21 : 21+keyLength]
+	ciphertext := body[21+keyLength:]
+
+	key, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := uaPrivate.ECDH(key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(auth, secret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) == 0 || plaintext[len(plaintext)-1] != 2 {
+		return nil, errors.New("invalid padding")
+	}
+
+	return plaintext[:len(plaintext)-1], nil
+}
+
+// Checks the VAPID JWT of a push request.
+func verifyVAPID(authorization, publicKey, audience string) error {
+	var token, key string
+	for _, part := range strings.Split(strings.TrimPrefix(authorization, "vapid "), ",") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "t=") {
+			token = part[2:]
+		} else if strings.HasPrefix(part, "k=") {
+			key = part[2:]
+		}
+	}
+	if key != publicKey {
+		return errors.New("invalid key")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("invalid token")
+	}
+
+	raw, _ := base64.RawURLEncoding.DecodeString(key)
+	public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(raw[1:33]), Y: new(big.Int).SetBytes(raw[33:])}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(signature) != 64 || !ecdsa.Verify(public, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return errors.New("invalid signature")
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return err
+	}
+	if claims.Aud != audience || claims.Exp < time.Now().Unix() || claims.Sub != "mailto:test@example.com" {
+		return fmt.Errorf("invalid claims: %+v", claims)
+	}
+
+	return nil
+}
+
+func TestWebPush(t *testing.T) {
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+
+	pushes := make(chan []byte, 2)
+	var vapidKey, audience string
+	pushService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if err := verifyVAPID(r.Header.Get("Authorization"), vapidKey, audience); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		message, err := decryptWebPush(body, uaPrivate, auth)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pushes <- message
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer pushService.Close()
+	audience = pushService.URL
+
+	testWithServer(startWebPushDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		const origin = "https://app.example.com"
+		center := genRandomHash(128)
+		resp := postService("newcenter?mail=test@example.com&webpushorigin="+url.QueryEscape(origin), center, key, t)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		centername := getCenterName("test@example.com", center)
+
+		resp, err := http.Get(getPath("webpush/key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vapidKey = getBody(resp)
+		if raw, err := base64.RawURLEncoding.DecodeString(vapidKey); err != nil || len(raw) != 65 {
+			t.Fatalf("Invalid VAPID key: %s\n", vapidKey)
+		}
+
+		subscription := func(endpoint string) string {
+			return fmt.Sprintf(`{"endpoint":"%s","expirationTime":null,"keys":{"p256dh":"%s","auth":"%s"}}`, endpoint,
+				base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()), base64.RawURLEncoding.EncodeToString(auth))
+		}
+		subscribeFrom := func(origin, center, body string, expected int) {
+			req, _ := http.NewRequest("POST", getPath("webpush/subscribe?center="+url.QueryEscape(center)), strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != expected {
+				t.Fatalf("Invalid status code of the subscription. Expected: %d, got: %d\n", expected, resp.StatusCode)
+			}
+		}
+		subscribe := func(center, body string, expected int) {
+			subscribeFrom(origin, center, body, expected)
+		}
+
+		subscribeFrom("", centername, subscription(pushService.URL+"/push"), http.StatusForbidden)
+		subscribeFrom("https://evil.example.com", centername, subscription(pushService.URL+"/push"), http.StatusForbidden)
+		subscribe("missing", subscription(pushService.URL+"/push"), http.StatusNotFound)
+		subscribe(centername, `{"endpoint":"`+pushService.URL+`/push","keys":{"p256dh":"invalid","auth":"invalid"}}`, http.StatusBadRequest)
+		subscribe(centername, subscription("ftp://example.com/push"), http.StatusBadRequest)
+		subscribe(centername, subscription(pushService.URL+"/push"), http.StatusCreated)
+		subscribe(centername, subscription(pushService.URL+"/gone"), http.StatusCreated)
+
+		testmsg := testNotificationSending(key, t, center, true)
+		select {
+		case message := <-pushes:
+			if string(message) != testmsg {
+				t.Fatalf("Invalid push message. Expected: %s, got: %s\n", testmsg, message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("The message is not pushed.")
+		}
+
+		unsubscribe := func(endpoint string, expected int) {
+			req, _ := http.NewRequest("POST", getPath("webpush/unsubscribe?center="+url.QueryEscape(centername)), strings.NewReader(subscription(endpoint)))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Origin", origin)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != expected {
+				t.Fatalf("Invalid status code of the unsubscription. Expected: %d, got: %d\n", expected, resp.StatusCode)
+			}
+		}
+
+		// The messages are pushed one after the other, so the gone subscription is dropped by the time the next
+		// message arrives.
+		testmsg = testNotificationSending(key, t, center, true)
+		select {
+		case message := <-pushes:
+			if string(message) != testmsg {
+				t.Fatalf("Invalid push message. Expected: %s, got: %s\n", testmsg, message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("The message is not pushed.")
+		}
+		unsubscribe(pushService.URL+"/gone", http.StatusNotFound)
+
+		unsubscribe(pushService.URL+"/push", http.StatusOK)
+		unsubscribe(pushService.URL+"/push", http.StatusNotFound)
+
+		// The subscriptions of a center are rate limited.
+		limited := false
+		for i := 0; i < 2*webPushSubscribeRate && !limited; i++ {
+			req, _ := http.NewRequest("POST", getPath("webpush/subscribe?center="+url.QueryEscape(centername)), strings.NewReader(subscription(pushService.URL+"/push")))
+			req.Header.Set("Origin", origin)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			limited = resp.StatusCode == http.StatusTooManyRequests
+		}
+		if !limited {
+			t.Fatal("The subscriptions are not rate limited.")
+		}
+	})
+}
+
+func TestPrivateDestinations(t *testing.T) {
+	for _, destination := range []string{"https://127.0.0.1/push", "https://localhost/push", "https://10.1.2.3/push", "https://192.168.0.1/push", "https://169.254.169.254/latest", "https://[::1]/push", "https://[fe80::1]/push"} {
+		if err := checkDestination(destination, Config{}); err == nil {
+			t.Fatalf("Private destination is accepted: %s\n", destination)
+		}
+		if err := checkDestination(destination, Config{PrivateDestinations: true}); err != nil {
+			t.Fatalf("Private destination is refused with the privatedestinations option: %s\n", destination)
+		}
+	}
+
+	// The addresses are checked when they are connected too.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	if _, err := newDestinationClient(Config{}).Get(server.URL); err == nil {
+		t.Fatal("Private address is connected.")
+	}
+	resp, err := newDestinationClient(Config{PrivateDestinations: true}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The upstreams and the webhooks are restricted like the push endpoints.
+	testWithServer(startBasicDummyServer, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		if resp := postService("newcenter?mail=test@example.com&upstream="+url.QueryEscape(server.URL), "test", key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Private upstream is accepted. Code: %d\n", resp.StatusCode)
+		}
+
+		center := testNotificationCenterCreation(key, t)
+		if resp := postService("webhooks/add?mail=test@example.com&url="+url.QueryEscape(server.URL), center, key, t); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Private webhook is accepted. Code: %d\n", resp.StatusCode)
+		}
+	})
+}
+
+func TestBackplane(t *testing.T) {
+	bus := NewLocalBus()
+	backend := NewDummyBackend()
+	startNode := func(address string, t *testing.T) *GoPushService {
+		config := getBaseConfig()
+		config.Address = address
+		svc := startServer(config, backend, t)
+		if err := svc.SetBackplane(NewLocalBackplane(bus)); err != nil {
+			t.Fatal(err)
+		}
+		return svc
+	}
+
+	testWithServer(func(t *testing.T) *GoPushService {
+		return startNode(fmt.Sprintf("localhost:%d", port), t)
+	}, t, func(t *testing.T) {
+		other := startNode(fmt.Sprintf("localhost:%d", port+1000), t)
+		defer other.Stop()
+		<-time.After(100 * time.Millisecond)
+
+		otherPath := func(path, proto string) string {
+			return fmt.Sprintf("%s://localhost:%d/%s", proto, port+1000, path)
+		}
+		ping := func(centername string) int {
+			resp, err := http.DefaultClient.Get(otherPath("ping?center="+centername, "http"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		center := testNotificationCenterCreation(key, t)
+		centername := getCenterName("test@example.com", center)
+		for i := 0; ping(centername) != http.StatusOK; i++ {
+			if i == 20 {
+				t.Fatal("The notification center was not created on the other node.")
+			}
+			<-time.After(50 * time.Millisecond)
+		}
+
+		wsconn, err := websocket.Dial(otherPath("listen?center="+centername, "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+		<-time.After(100 * time.Millisecond)
+
+		msg := testNotificationSending(key, t, center, true)
+		wsconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var received string
+		if err := websocket.Message.Receive(wsconn, &received); err != nil {
+			t.Fatal(err)
+		}
+		if received != msg {
+			t.Fatalf("Invalid message on the other node. Expected: %s, got: %s\n", msg, received)
+		}
+
+		// Both nodes have a timer for the scheduled notification, but only one delivers it.
+		if resp := postService("notify?mail=test@example.com&delay=1&center="+center, "scheduled", key, t); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Failed to schedule a notification, code: %d\n", resp.StatusCode)
+		}
+		other.restoreScheduled()
+		wsconn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if err := websocket.Message.Receive(wsconn, &received); err != nil || received != "scheduled" {
+			t.Fatalf("The scheduled notification is not delivered: %s %v\n", received, err)
+		}
+		wsconn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+		if err := websocket.Message.Receive(wsconn, &received); err == nil {
+			t.Fatalf("The scheduled notification is delivered twice: %s\n", received)
+		}
+
+		// The listener activity on the other node keeps a center with an idle timeout on this node too.
+		if resp := postService("newcenter?mail=test@example.com&idletimeout=2", "idle", key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		idlename := getCenterName("test@example.com", "idle")
+		for i := 0; ping(idlename) != http.StatusOK; i++ {
+			if i == 20 {
+				t.Fatal("The notification center was not created on the other node.")
+			}
+			<-time.After(50 * time.Millisecond)
+		}
+		idleconn, err := websocket.Dial(otherPath("listen?center="+idlename, "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idleconn.Close()
+		for i := 0; i < 8; i++ {
+			if err := websocket.Message.Send(idleconn, "activity"); err != nil {
+				t.Fatal(err)
+			}
+			<-time.After(400 * time.Millisecond)
+		}
+		if _, ok := other.getCenter(idlename); !ok {
+			t.Fatal("The notification center with listener activity expired.")
+		}
+		testNotificationCenterRemoval(key, t, "idle")
+
+		wsconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		testNotificationCenterRemoval(key, t, center)
+		if err := websocket.Message.Receive(wsconn, &received); err == nil {
+			t.Fatal("The connection to the removed notification center is still open.")
+		}
+		if code := ping(centername); code != http.StatusNotFound {
+			t.Fatalf("The notification center was not removed on the other node, code: %d\n", code)
+		}
+	})
+}
+
+func TestSharding(t *testing.T) {
+	backend := NewDummyBackend()
+	first := fmt.Sprintf("http://localhost:%d", port)
+	second := fmt.Sprintf("http://localhost:%d", port+1000)
+	startNode := func(peerurl, routing string, t *testing.T) *GoPushService {
+		config := getBaseConfig()
+		config.Address = strings.TrimPrefix(peerurl, "http://")
+		config.Peers = []string{first, second}
+		config.PeerURL = peerurl
+		config.PeerRouting = routing
+		return startServer(config, backend, t)
+	}
+
+	ring := newHashRing([]string{first, second})
+	centerOf := func(owner string) string {
+		for {
+			center := genRandomHash(16)
+			if ring.owner(getCenterName("test@example.com", center)) == owner {
+				return center
+			}
+		}
+	}
+
+	var node *GoPushService
+	testWithServer(func(t *testing.T) *GoPushService {
+		node = startNode(first, routingRedirect, t)
+		return node
+	}, t, func(t *testing.T) {
+		other := startNode(second, routingProxy, t)
+		defer other.Stop()
+		<-time.After(100 * time.Millisecond)
+
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		// The first node redirects to the owner.
+		remote := centerOf(second)
+		if resp := postService("newcenter?mail=test@example.com", remote, key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+		if _, ok := other.centers[getCenterName("test@example.com", remote)]; !ok {
+			t.Fatal("The notification center was not created on its owner.")
+		}
+		if _, ok := node.centers[getCenterName("test@example.com", remote)]; ok {
+			t.Fatal("The notification center was created on the wrong node.")
+		}
+
+		conn, r := dialRawWebsocket("listen?center="+getCenterName("test@example.com", remote), t)
+		defer conn.Close()
+		if code, reason := readCloseFrame(r, t); code != closeMoved || reason != fmt.Sprintf("ws://localhost:%d", port+1000) {
+			t.Fatalf("Invalid close frame. Expected: %d, got: %d '%s'\n", closeMoved, code, reason)
+		}
+
+		// The second node proxies to the owner.
+		local := centerOf(first)
+		if resp := postService("newcenter?mail=test@example.com", local, key, t); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create notification center, code: %d\n", resp.StatusCode)
+		}
+
+		wsconn, err := websocket.Dial(fmt.Sprintf("%s/listen?center=%s", strings.Replace(second, "http", "ws", 1), getCenterName("test@example.com", local)), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wsconn.Close()
+		<-time.After(100 * time.Millisecond)
+
+		msg := genRandomHash(32)
+		req, err := http.NewRequest("POST", second+"/notify?mail=test@example.com&center="+local, strings.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "GoPush "+sign(msg, key))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to send a notification through the other node, code: %d\n", resp.StatusCode)
+		}
+		resp.Body.Close()
+
+		wsconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var received string
+		if err := websocket.Message.Receive(wsconn, &received); err != nil {
+			t.Fatal(err)
+		}
+		if received != msg {
+			t.Fatalf("Invalid message through the proxy. Expected: %s, got: %s\n", msg, received)
+		}
+
+		// The requests of several centers reach every node.
+		var broadcast broadcastResult
+		if err := json.Unmarshal([]byte(getBody(postService("notify/broadcast?mail=test@example.com", "broadcast", key, t))), &broadcast); err != nil {
+			t.Fatal(err)
+		}
+		if broadcast.Centers != 2 || broadcast.Listeners != 1 {
+			t.Fatalf("Invalid broadcast result: %+v\n", broadcast)
+		}
+
+		batch := fmt.Sprintf(`[{"center":"%s","message":"a"},{"center":"%s","message":"b"},{"center":"missing","message":"c"}]`, remote, local)
+		var results []batchResult
+		if err := json.Unmarshal([]byte(getBody(postService("notify/batch?mail=test@example.com", batch, key, t))), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 3 || results[0].Status != http.StatusOK || results[1].Status != http.StatusOK || results[2].Status != http.StatusNotFound {
+			t.Fatalf("Invalid batch results: %+v\n", results)
+		}
+
+		var list []centerInfo
+		if err := json.Unmarshal([]byte(getBody(getService("centers?mail=test@example.com", key, t))), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 {
+			t.Fatalf("Invalid list of centers: %+v\n", list)
+		}
+
+		// The report is kept by the owner of the center.
+		resp = postService("notify?mail=test@example.com&center="+remote, "reported", key, t)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to send a notification, code: %d\n", resp.StatusCode)
+		}
+		if resp := postService("report?mail=test@example.com", getBody(resp), key, t); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to get the delivery report of another node, code: %d\n", resp.StatusCode)
+		}
+	})
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	var svc *GoPushService
+	testWithServer(func(t *testing.T) *GoPushService {
+		svc = startBasicDummyServer(t)
+		return svc
+	}, t, func(t *testing.T) {
+		key := testAdminAdd("test@example.com", t)
+		if key == nil {
+			t.Fatal("Invalid key")
+		}
+
+		center := testNotificationCenterCreation(key, t)
+		centername := getCenterName("test@example.com", center)
+
+		conn, r := dialRawWebsocket("listen?center="+centername, t)
+		defer conn.Close()
+		listener, err := websocket.Dial(getRawPath("listen?center="+centername, "ws"), "", getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		// Without subscriptions no hub closes it.
+		muxconn, err := websocket.Dial(getRawPath("listen", "ws"), muxProtocol, getPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer muxconn.Close()
+		<-time.After(100 * time.Millisecond)
+
+		sent := make([]string, 20)
+		for i := range sent {
+			sent[i] = testNotificationSending(key, t, center, true)
+		}
+
+		start := time.Now()
+		svc.Stop()
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("The shutdown took %s.\n", time.Since(start))
+		}
+
+		if code, reason := readCloseFrame(r, t); code != closeGoingAway || reason != "server shutting down" {
+			t.Fatalf("Invalid close frame. Expected: %d, got: %d '%s'\n", closeGoingAway, code, reason)
+		}
+
+		listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var received string
+		for i, msg := range sent {
+			if err := websocket.Message.Receive(listener, &received); err != nil {
+				t.Fatalf("Message %d was not delivered before the shutdown: %s\n", i, err.Error())
+			}
+			if received != msg {
+				t.Fatalf("Invalid message. Expected: %s, got: %s\n", msg, received)
+			}
+		}
+		if err := websocket.Message.Receive(listener, &received); err != io.EOF {
+			t.Fatalf("The connection was not closed: %v\n", err)
+		}
+
+		muxconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := websocket.Message.Receive(muxconn, &received); err != io.EOF {
+			t.Fatalf("The multiplexed connection was not closed: %v\n", err)
+		}
+
+		if _, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port)); err == nil {
+			t.Fatal("The server still accepts connections.")
+		}
+	})
+}
+
+func TestSTOMPFrameLimit(t *testing.T) {
+	read := func(data string) error {
+		_, err := readSTOMPFrame(bufio.NewReader(strings.NewReader(data)), 64)
+		return err
+	}
+
+	if err := read(strings.Repeat("\n", 100) + "SEND\ndestination:/center/a\n\nbody\x00"); err != nil {
+		t.Fatalf("Valid frame is refused: %v\n", err)
+	}
+	for _, data := range []string{
+		"SEND\ndestination:" + strings.Repeat("a", 100) + "\n\n\x00",
+		"SEND\n\n" + strings.Repeat("a", 100) + "\x00",
+		"SEND\ncontent-length:100\n\n" + strings.Repeat("a", 100) + "\x00",
+		strings.Repeat("A", 100000),
+	} {
+		if err := read(data); err != errSTOMPMalformed {
+			t.Fatalf("Oversized frame is not refused: %v\n", err)
+		}
+	}
+
+	config := Config{UpstreamMaxMessageSize: 100}
+	if limit := stompFrameLimit(config); limit != 100+stompMaxHeaderSize {
+		t.Fatalf("Invalid frame limit: %d\n", limit)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	testfunc := func(document, patch, expected string, shouldSucceed bool) {
+		result, err := applyPatch(documentJSONPatch, document, patch)
+		if shouldSucceed && err != nil {
+			t.Fatalf("Failed to apply '%s': %s\n", patch, err.Error())
+		}
+		if !shouldSucceed && err == nil {
+			t.Fatalf("Patch '%s' is applied, but it should fail.\n", patch)
+		}
+		if shouldSucceed && result != expected {
+			t.Fatalf("Invalid result of '%s'. Expected: '%s', got: '%s'\n", patch, expected, result)
+		}
+	}
+
+	// Examples from RFC 6902, appendix A.
+	testfunc(`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, true)
+	testfunc(`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, true)
+	testfunc(`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, true)
+	testfunc(`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, true)
+	testfunc(`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, true)
+	testfunc(`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, true)
+	testfunc(`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, true)
+	testfunc(`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`, true)
+	testfunc(`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, "", false)
+	testfunc(`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, "", false)
+	testfunc(`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`, true)
+	testfunc(`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":"10"}]`, "", false)
+	testfunc(`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`, true)
+	testfunc(`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`, true)
+	testfunc(`{"foo":"bar"}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"baz":"bar","foo":"bar"}`, true)
+	testfunc(`{"foo":1.0}`, `[{"op":"test","path":"/foo","value":1}]`, `{"foo":1.0}`, true)
+	testfunc(`{}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`, true)
+
+	// Null values.
+	testfunc(`{}`, `[{"op":"add","path":"/a","value":null}]`, `{"a":null}`, true)
+	testfunc(`{"a":1}`, `[{"op":"replace","path":"/a","value":null}]`, `{"a":null}`, true)
+	testfunc(`{"a":null}`, `[{"op":"test","path":"/a","value":null}]`, `{"a":null}`, true)
+	testfunc(`{"a":1}`, `[{"op":"test","path":"/a","value":null}]`, "", false)
+	testfunc(`{}`, `[{"op":"add","path":"/a"}]`, "", false)
+
+	// Trailing data.
+	testfunc(`{}`, `[{"op":"add","path":"/a","value":1}]]`, "", false)
+	testfunc(`{}`, `[{"op":"add","path":"/a","value":1}]}`, "", false)
+	testfunc(`{}`, `[{"op":"add","path":"/a","value":1}] []`, "", false)
+	testfunc(`{}`, `[{"op":"add","path":"/a","value":1}] `, `{"a":1}`, true)
+	if _, err := applyPatch(documentMerge, `{}`, `{"a":1}}`); err == nil {
+		t.Fatal("Merge patch with trailing data is applied.")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2)
+	if !l.allow() || !l.allow() {
+		t.Fatalf("The rate limiter does not allow the burst.\n")
+	}
+
+	if l.allow() {
+		t.Fatalf("The rate limiter allows more messages than the limit.\n")
+	}
+}
+
 func TestMySQLFunctional(t *testing.T) {
 	config := getBaseConfig()
 
@@ -665,7 +2971,7 @@ func TestMySQLFunctional(t *testing.T) {
 
 	testWithServer(serverStarter, t, func(t *testing.T) {
 		fullFunctionalTest(t)
-		_, err := backend.connection.Exec("DROP TABLE APIToken")
+		_, err := backend.connection.Exec("DROP TABLE APIToken, ScheduledNotification, NotificationCenter, PushSubscription")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -0,0 +1,103 @@
+package gopush
+
+import (
+	"net/http"
+	"time"
+)
+
+const defaultIdempotencyWindow = 24 * time.Hour
+
+type idempotentResult struct {
+	done   chan bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Records the response of a request, so it can be replayed for the retries of the request.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	result *idempotentResult
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	if r.result.status == 0 {
+		r.result.status = status
+		r.result.header = r.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.result.status == 0 {
+		r.result.status = http.StatusOK
+		r.result.header = r.Header().Clone()
+	}
+	r.result.body = append(r.result.body, b...)
+	return r.ResponseWriter.Write(b)
+}
+
+func (svc *GoPushService) getIdempotencyWindow() time.Duration {
+	if svc.config.IdempotencyWindow > 0 {
+		return time.Duration(svc.config.IdempotencyWindow) * time.Second
+	}
+
+	return defaultIdempotencyWindow
+}
+
+// Runs the handler once per idempotency key and center. Retries with the same key get the original response,
+// even if they arrive while the first request is still in progress.
+func (svc *GoPushService) handleIdempotent(w http.ResponseWriter, c *notificationCenter, key string, handler func(http.ResponseWriter)) {
+	svc.idempotencyLock.Lock()
+	if c.idempotency == nil {
+		c.idempotency = make(map[string]*idempotentResult)
+	}
+	result, found := c.idempotency[key]
+	if !found {
+		result = &idempotentResult{done: make(chan bool)}
+		c.idempotency[key] = result
+	}
+	svc.idempotencyLock.Unlock()
+
+	if found {
+		<-result.done
+		for name, values := range result.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(result.status)
+		w.Write(result.body)
+		return
+	}
+
+	// The waiting retries are released even if the handler panics.
+	completed := false
+	defer func() {
+		if !completed {
+			result.status = http.StatusInternalServerError
+			result.header = nil
+			result.body = nil
+		}
+
+		// Failed requests can be retried.
+		svc.idempotencyLock.Lock()
+		if result.status >= 500 {
+			delete(c.idempotency, key)
+		} else {
+			time.AfterFunc(svc.getIdempotencyWindow(), func() {
+				svc.idempotencyLock.Lock()
+				delete(c.idempotency, key)
+				svc.idempotencyLock.Unlock()
+			})
+		}
+		svc.idempotencyLock.Unlock()
+
+		close(result.done)
+	}()
+
+	handler(&idempotencyRecorder{ResponseWriter: w, result: result})
+	if result.status == 0 {
+		result.status = http.StatusOK
+	}
+	completed = true
+}
@@ -0,0 +1,463 @@
+package gopush
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Patch formats of the document centers.
+const (
+	documentMerge     = "merge"     // RFC 7396 JSON Merge Patch
+	documentJSONPatch = "jsonpatch" // RFC 6902 JSON Patch
+)
+
+var (
+	errInvalidDocumentFormat = errors.New("Invalid document parameter. Supported formats: merge, jsonpatch.")
+	errInvalidDocument       = errors.New("The state of a document center must be a JSON document.")
+	errInvalidPatch          = errors.New("Invalid patch.")
+	errPatchTestFailed       = errors.New("Patch test operation failed.")
+	errInvalidPointer        = errors.New("Invalid JSON pointer in the patch.")
+	errPathNotFound          = errors.New("Path of the patch does not exist in the document.")
+)
+
+func validateDocumentFormat(format string) error {
+	switch format {
+	case "", documentMerge, documentJSONPatch:
+		return nil
+	}
+
+	return errInvalidDocumentFormat
+}
+
+func decodeJSON(data string) (interface{}, error) {
+	d := json.NewDecoder(strings.NewReader(data))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	// Trailing data is not allowed, not even a closing delimiter.
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errInvalidPatch
+	}
+
+	return v, nil
+}
+
+func encodeJSON(v interface{}) (string, error) {
+	marshaled, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(marshaled), nil
+}
+
+// Applies a patch in the given format to a JSON document, and returns the new document.
+func applyPatch(format, document, patch string) (string, error) {
+	doc, err := decodeJSON(document)
+	if err != nil {
+		return "", errInvalidDocument
+	}
+
+	switch format {
+	case documentMerge:
+		p, err := decodeJSON(patch)
+		if err != nil {
+			return "", errInvalidPatch
+		}
+		doc = mergePatch(doc, p)
+	case documentJSONPatch:
+		if doc, err = jsonPatch(doc, patch); err != nil {
+			return "", err
+		}
+	default:
+		return "", errInvalidDocumentFormat
+	}
+
+	return encodeJSON(doc)
+}
+
+// Returns a patch in the given format which turns the from document into the to document.
+func replacementPatch(format, from, to string) (string, error) {
+	target, err := decodeJSON(to)
+	if err != nil {
+		return "", errInvalidDocument
+	}
+
+	if format == documentJSONPatch {
+		return encodeJSON([]map[string]interface{}{{"op": "replace", "path": "", "value": target}})
+	}
+
+	source, err := decodeJSON(from)
+	if err != nil {
+		return "", errInvalidDocument
+	}
+
+	return encodeJSON(mergeDiff(source, target))
+}
+
+// RFC 7396, section 2.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], value)
+		}
+	}
+
+	return t
+}
+
+// Returns a merge patch which turns the source into the target.
+func mergeDiff(source, target interface{}) interface{} {
+	s, sok := source.(map[string]interface{})
+	t, tok := target.(map[string]interface{})
+	if !sok || !tok {
+		return target
+	}
+
+	diff := make(map[string]interface{})
+	for name := range s {
+		if _, ok := t[name]; !ok {
+			diff[name] = nil
+		}
+	}
+	for name, value := range t {
+		if old, ok := s[name]; !ok || !jsonEqual(old, value) {
+			diff[name] = mergeDiff(old, value)
+		}
+	}
+
+	return diff
+}
+
+// A null value is "null", a missing one is nil.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// RFC 6902. The operations are applied in order, and the whole patch fails if any of them fails.
+func jsonPatch(doc interface{}, patch string) (interface{}, error) {
+	var operations []patchOperation
+	if err := json.Unmarshal([]byte(patch), &operations); err != nil {
+		return nil, errInvalidPatch
+	}
+
+	for _, op := range operations {
+		if op.Path == nil {
+			return nil, errInvalidPatch
+		}
+
+		path, err := parsePointer(*op.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, errInvalidPatch
+			}
+			if value, err = decodeJSON(string(op.Value)); err != nil {
+				return nil, errInvalidPatch
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, errInvalidPatch
+			}
+			from, err := parsePointer(*op.From)
+			if err != nil {
+				return nil, err
+			}
+			if value, err = getPointer(doc, from); err != nil {
+				return nil, err
+			}
+			if op.Op == "move" {
+				if isPrefix(from, path) && len(from) < len(path) {
+					return nil, errInvalidPatch
+				}
+				if doc, err = removePointer(doc, from); err != nil {
+					return nil, err
+				}
+			} else {
+				value = deepCopy(value)
+			}
+		}
+
+		switch op.Op {
+		case "add", "move", "copy":
+			doc, err = addPointer(doc, path, value)
+		case "remove":
+			doc, err = removePointer(doc, path)
+		case "replace":
+			if doc, err = removePointer(doc, path); err == nil {
+				doc, err = addPointer(doc, path, value)
+			}
+		case "test":
+			var current interface{}
+			if current, err = getPointer(doc, path); err == nil && !jsonEqual(current, value) {
+				err = errPatchTestFailed
+			}
+		default:
+			err = errInvalidPatch
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// RFC 6901
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if pointer[0] != '/' {
+		return nil, errInvalidPointer
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the index of an array element. The "-" token refers to the end of the array, only if end is allowed.
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if token == "-" && end {
+		return length, nil
+	}
+
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, errPathNotFound
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 {
+		return 0, errPathNotFound
+	}
+
+	limit := length - 1
+	if end {
+		limit = length
+	}
+	if i > limit {
+		return 0, errPathNotFound
+	}
+
+	return i, nil
+}
+
+func getPointer(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errPathNotFound
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, errPathNotFound
+		}
+	}
+
+	return doc, nil
+}
+
+// Returns the document with the value added. The parent of the path must exist.
+func addPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := getPointer(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[i+1:], node[i:])
+		node[i] = value
+		return setPointer(doc, path[:len(path)-1], node)
+	}
+
+	return nil, errPathNotFound
+}
+
+func removePointer(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	parent, err := getPointer(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := node[token]; !ok {
+			return nil, errPathNotFound
+		}
+		delete(node, token)
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node[:i:i], node[i+1:]...)
+		return setPointer(doc, path[:len(path)-1], node)
+	}
+
+	return nil, errPathNotFound
+}
+
+// Arrays are values, so a changed array has to be put back into its parent.
+func setPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := getPointer(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = value
+	default:
+		return nil, errPathNotFound
+	}
+
+	return doc, nil
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(node))
+		for name, value := range node {
+			c[name] = deepCopy(value)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(node))
+		for i, value := range node {
+			c[i] = deepCopy(value)
+		}
+		return c
+	}
+
+	return v
+}
+
+// Numbers are compared by their value, not by their representation.
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for name, value := range x {
+			other, ok := y[name]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		return errx == nil && erry == nil && fx == fy
+	}
+
+	// Strings, booleans and null.
+	return a == b
+}
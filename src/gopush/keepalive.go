@@ -0,0 +1,115 @@
+package gopush
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+
+	"log"
+)
+
+// Text message sent to the clients which asked for application level heartbeats. If the client sends it back,
+// it is not forwarded to the upstream.
+const heartbeatMessage = `{"heartbeat":true}`
+
+// Every read extends the read deadline, so any traffic from the client (messages, pongs, heartbeats) keeps the
+// connection alive, and dead peers get dropped. The timeout can be changed by the handler of the connection.
+type deadlineConn struct {
+	net.Conn
+	timeout int64 // time.Duration, accessed atomically
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(time.Duration(atomic.LoadInt64(&c.timeout))))
+	}
+	return n, err
+}
+
+func (c *deadlineConn) setTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.timeout, int64(timeout))
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// Key of the deadlineConn in the context of the request.
+type deadlineConnKey struct{}
+
+// Changes the read timeout of a connection. Returns false if the service has no read timeout, then the deadline of
+// the connection is not extended by the reads.
+func setReadTimeout(conn *websocket.Conn, timeout time.Duration) bool {
+	dc, ok := conn.Request().Context().Value(deadlineConnKey{}).(*deadlineConn)
+	if !ok || dc.Conn == nil {
+		return false
+	}
+
+	dc.setTimeout(timeout)
+	return true
+}
+
+// The websocket package hijacks the connection from the response writer, this is where the connection gets wrapped.
+type deadlineResponseWriter struct {
+	http.ResponseWriter
+	conn *deadlineConn
+}
+
+func (w *deadlineResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dc := w.conn
+	dc.Conn = conn
+	dc.setTimeout(time.Duration(atomic.LoadInt64(&dc.timeout)))
+
+	// Keep the data which is already read from the connection.
+	var reader io.Reader = dc
+	if n := buf.Reader.Buffered(); n > 0 {
+		buffered, _ := buf.Reader.Peek(n)
+		reader = io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), dc)
+	}
+
+	return dc, bufio.NewReadWriter(bufio.NewReader(reader), buf.Writer), nil
+}
+
+// The read timeout only keeps the passive listeners, which send nothing but pongs, if the pings are sent more often.
+// Otherwise the ping interval is derived from the read timeout.
+func checkKeepalive(config Config) Config {
+	if config.ReadTimeout <= 0 || config.PingInterval > 0 && config.PingInterval < config.ReadTimeout {
+		return config
+	}
+
+	config.PingInterval = config.ReadTimeout / 2
+	if config.PingInterval == 0 {
+		config.PingInterval = 1
+	}
+	log.Printf("Ping interval must be shorter than the read timeout, it is set to %d second(s).\n", config.PingInterval)
+
+	return config
+}
+
+func withReadTimeout(h http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dc := &deadlineConn{timeout: int64(timeout)}
+		h.ServeHTTP(&deadlineResponseWriter{ResponseWriter: w, conn: dc}, r.WithContext(context.WithValue(r.Context(), deadlineConnKey{}, dc)))
+	})
+}
+
+// Sends a ping frame. It must not be called concurrently with other writes.
+func writePing(conn *websocket.Conn) error {
+	conn.PayloadType = websocket.PingFrame
+	_, err := conn.Write(nil)
+	return err
+}
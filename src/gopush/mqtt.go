@@ -0,0 +1,376 @@
+package gopush
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+
+	"log"
+)
+
+// MQTT 3.1.1 over websocket. The topics are the names of the centers, and the retained message of a topic is the
+// state of its center. The subscriptions are QoS 0.
+const mqttProtocol = "mqtt"
+
+const mqttMaxPacketSize = 1 << 20
+
+// Packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// CONNACK and SUBACK return codes
+const (
+	mqttAccepted             = 0
+	mqttUnacceptableProtocol = 1
+	mqttIdentifierRejected   = 2
+	mqttSubscriptionFailure  = 0x80
+)
+
+// CONNECT flags
+const (
+	mqttConnectFlagUsername     = 0x80
+	mqttConnectFlagPassword     = 0x40
+	mqttConnectFlagWill         = 0x04
+	mqttConnectFlagCleanSession = 0x02
+)
+
+var errMQTTMalformed = errors.New("malformed MQTT packet")
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// Reads a packet from the stream of the websocket frames. A packet can span several frames.
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	for i, multiplier := 0, 1; ; i, multiplier = i+1, multiplier*128 {
+		if i == 4 {
+			return nil, errMQTTMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > mqttMaxPacketSize {
+		return nil, errMQTTMalformed
+	}
+
+	p := &mqttPacket{kind: header >> 4, flags: header & 0x0f, body: make([]byte, length)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func encodeMQTTPacket(kind, flags byte, body []byte) []byte {
+	packet := []byte{kind<<4 | flags}
+
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// Reads the fields of the variable header and the payload.
+type mqttDecoder struct {
+	body []byte
+	err  error
+}
+
+func (d *mqttDecoder) readUint16() uint16 {
+	if d.err != nil || len(d.body) < 2 {
+		d.err = errMQTTMalformed
+		return 0
+	}
+
+	v := binary.BigEndian.Uint16(d.body)
+	d.body = d.body[2:]
+
+	return v
+}
+
+func (d *mqttDecoder) readByte() byte {
+	if d.err != nil || len(d.body) < 1 {
+		d.err = errMQTTMalformed
+		return 0
+	}
+
+	v := d.body[0]
+	d.body = d.body[1:]
+
+	return v
+}
+
+func (d *mqttDecoder) readString() string {
+	length := int(d.readUint16())
+	if d.err != nil || len(d.body) < length {
+		d.err = errMQTTMalformed
+		return ""
+	}
+
+	v := string(d.body[:length])
+	d.body = d.body[length:]
+
+	return v
+}
+
+type mqttConnectPacket struct {
+	protocol  string
+	level     byte
+	flags     byte
+	keepalive uint16
+	clientID  string
+}
+
+func decodeMQTTConnect(p *mqttPacket) (*mqttConnectPacket, error) {
+	d := &mqttDecoder{body: p.body}
+	c := &mqttConnectPacket{
+		protocol:  d.readString(),
+		level:     d.readByte(),
+		flags:     d.readByte(),
+		keepalive: d.readUint16(),
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if c.protocol != "MQTT" {
+		return c, nil
+	}
+
+	c.clientID = d.readString()
+	if c.flags&mqttConnectFlagWill != 0 {
+		d.readString()
+		d.readString()
+	}
+	if c.flags&mqttConnectFlagUsername != 0 {
+		d.readString()
+	}
+	if c.flags&mqttConnectFlagPassword != 0 {
+		d.readString()
+	}
+
+	return c, d.err
+}
+
+func mqttPacketID(id uint16) []byte {
+	return []byte{byte(id >> 8), byte(id)}
+}
+
+func (svc *GoPushService) mqttHandler(conn *websocket.Conn) {
+	r := bufio.NewReader(conn)
+
+	p, err := readMQTTPacket(r)
+	if err != nil || p.kind != mqttConnect {
+		conn.Close()
+		return
+	}
+
+	connect, err := decodeMQTTConnect(p)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// MQTT 3.1.1 only
+	if connect.protocol != "MQTT" || connect.level != 4 {
+		websocket.Message.Send(conn, encodeMQTTPacket(mqttConnack, 0, []byte{0, mqttUnacceptableProtocol}))
+		conn.Close()
+		return
+	}
+
+	// Sessions are not kept, so the client has to ask for a clean session if it does not send an identifier.
+	if connect.clientID == "" && connect.flags&mqttConnectFlagCleanSession == 0 {
+		websocket.Message.Send(conn, encodeMQTTPacket(mqttConnack, 0, []byte{0, mqttIdentifierRejected}))
+		conn.Close()
+		return
+	}
+
+	if err := websocket.Message.Send(conn, encodeMQTTPacket(mqttConnack, 0, []byte{0, mqttAccepted})); err != nil {
+		conn.Close()
+		return
+	}
+
+	m := newMuxConnection(conn, listenOptions{ID: connect.clientID}, svc.config, svc.goingAway)
+
+	// A client with a keepalive sends PINGREQ packets, the server does not ping it. The pongs would keep it alive.
+	pingInterval := time.Duration(svc.config.PingInterval) * time.Second
+	if connect.keepalive > 0 {
+		pingInterval = 0
+	}
+
+	go m.mqttReader(svc, r, time.Duration(connect.keepalive)*time.Second)
+	m.run(pingInterval, func(out muxOutgoing) bool {
+		if out.sub == nil {
+			return websocket.Message.Send(conn, out.frame.([]byte)) == nil
+		}
+
+		// There is nothing to tell to the client when a center closes the subscription.
+		if out.message == nil {
+			return true
+		}
+
+		// An empty retained message means that there is no retained message.
+		if out.message.initial && out.message.data == "" {
+			return true
+		}
+
+		var flags byte
+		if out.message.initial {
+			flags = 1 // RETAIN
+		}
+
+		body := appendMQTTString(nil, out.key)
+		body = append(body, m.payload(out.sub, out.message)...)
+
+		return websocket.Message.Send(conn, encodeMQTTPacket(mqttPublish, flags, body)) == nil
+	})
+}
+
+func (m *muxConnection) mqttReader(svc *GoPushService, r *bufio.Reader, keepalive time.Duration) {
+	defer m.close(0)
+
+	// The client has one and a half times the keepalive to send a packet. It replaces the read timeout of the service.
+	perPacket := keepalive > 0 && !setReadTimeout(m.conn, keepalive*3/2)
+
+	for {
+		if perPacket {
+			m.conn.SetReadDeadline(time.Now().Add(keepalive * 3 / 2))
+		}
+
+		p, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+
+		d := &mqttDecoder{body: p.body}
+
+		switch p.kind {
+		case mqttSubscribe:
+			id := d.readUint16()
+			var topics []string
+			var codes []byte
+			for d.err == nil && len(d.body) > 0 {
+				topic := d.readString()
+				d.readByte() // Requested QoS, only QoS 0 is granted.
+				topics = append(topics, topic)
+				if hub, ok := svc.getHub(topic); !ok || strings.ContainsAny(topic, "+#") || !hub.allowOrigin(connectionOrigin(m.conn)) {
+					codes = append(codes, mqttSubscriptionFailure)
+				} else {
+					codes = append(codes, 0)
+				}
+			}
+			if d.err != nil || len(topics) == 0 {
+				return
+			}
+
+			// The SUBACK goes before the retained messages.
+			m.reply(encodeMQTTPacket(mqttSuback, 0, append(mqttPacketID(id), codes...)))
+			for i, topic := range topics {
+				if codes[i] == mqttSubscriptionFailure {
+					continue
+				}
+				// A repeated subscription replaces the old one, and the retained message is sent again.
+				m.unsubscribe(topic)
+				if hub, ok := svc.getHub(topic); ok {
+					m.subscribe(topic, hub, subscriptionOptions{State: true}, nil)
+				}
+			}
+		case mqttUnsubscribe:
+			id := d.readUint16()
+			for d.err == nil && len(d.body) > 0 {
+				m.unsubscribe(d.readString())
+			}
+			if d.err != nil {
+				return
+			}
+			m.reply(encodeMQTTPacket(mqttUnsuback, 0, mqttPacketID(id)))
+		case mqttPublish:
+			qos := (p.flags >> 1) & 0x03
+			topic := d.readString()
+			var id uint16
+			if qos > 0 {
+				id = d.readUint16()
+			}
+			if d.err != nil || qos > 2 {
+				return
+			}
+
+			// Messages are forwarded to the upstream of a subscribed center.
+			if sub := m.subscription(topic); sub != nil {
+				sub.hub.touch()
+				if sub.hub.upstream != nil && !sub.hub.upstream.deliver(sub, string(d.body)) && m.verbose {
+					log.Println("Message of a client is dropped.")
+				}
+			}
+
+			switch qos {
+			case 1:
+				m.reply(encodeMQTTPacket(mqttPuback, 0, mqttPacketID(id)))
+			case 2:
+				m.reply(encodeMQTTPacket(mqttPubrec, 0, mqttPacketID(id)))
+			}
+		case mqttPubrel:
+			id := d.readUint16()
+			if d.err != nil {
+				return
+			}
+			m.reply(encodeMQTTPacket(mqttPubcomp, 0, mqttPacketID(id)))
+		case mqttPingreq:
+			m.reply(encodeMQTTPacket(mqttPingresp, 0, nil))
+		case mqttDisconnect:
+			return
+		default:
+			// A second CONNECT, or a packet which is sent only by servers.
+			return
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package gopush
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+
+	"log"
+)
+
+// Websocket subprotocol of the connections which listen to several centers.
+const muxProtocol = "gopush-mux"
+
+var errAlreadySubscribed = errors.New("already subscribed")
+
+// A connection which listens to several centers. Every subscription is registered in the hub of its center as a
+// separate wsconnection, so the presence, the delivery reports and the slow consumer policies work per center. A
+// goroutine per subscription forwards the messages to the connection.
+type muxConnection struct {
+	conn    *websocket.Conn
+	options listenOptions
+	verbose bool
+	// Text message sent instead of the ping frames, if the client asked for heartbeats.
+	heartbeat string
+	out       chan muxOutgoing
+	// Close code of the connection, or 0 if the client is gone.
+	quit chan int
+	// Closed when the connection is closed, stops the forwarders.
+	done chan bool
+	// Closed when the service shuts down, also the connections without subscriptions have to go.
+	goingAway     <-chan bool
+	lock          sync.Mutex
+	subscriptions map[string]*wsconnection
+	// The delivered messages of the subscriptions with acknowledgements.
+	acks *pendingAcks
+}
+
+// A message of a subscription, or the end of the subscription if the message is nil. Without a subscription it
+// carries a protocol specific frame of the reader, as only the writer may write to the connection.
+type muxOutgoing struct {
+	key     string
+	sub     *wsconnection
+	message *hubMessage
+	frame   interface{}
+}
+
+func newMuxConnection(conn *websocket.Conn, options listenOptions, config Config, goingAway <-chan bool) *muxConnection {
+	m := &muxConnection{
+		conn:          conn,
+		options:       options,
+		verbose:       config.ExtraLogging,
+		out:           make(chan muxOutgoing, defaultSendBuffer),
+		quit:          make(chan int, 1),
+		done:          make(chan bool),
+		goingAway:     goingAway,
+		subscriptions: make(map[string]*wsconnection),
+		acks:          newPendingAcks(),
+	}
+	if options.Heartbeat {
+		m.heartbeat = heartbeatMessage
+	}
+
+	return m
+}
+
+// Options of a subscription of a multiplexed connection.
+type subscriptionOptions struct {
+	State   bool // The current state is the first message.
+	Patches bool
+	Ack     bool
+}
+
+// Subscribes to a hub. The key identifies the subscription within the connection. The confirmation frame is sent
+// before any message of the subscription.
+func (m *muxConnection) subscribe(key string, h *wshub, options subscriptionOptions, confirmation interface{}) error {
+	m.lock.Lock()
+	if _, ok := m.subscriptions[key]; ok {
+		m.lock.Unlock()
+		return errAlreadySubscribed
+	}
+
+	sub := &wsconnection{
+		conn:      m.conn,
+		send:      make(chan *hubMessage, h.sendBuffer),
+		hub:       h,
+		id:        m.options.ID,
+		ack:       options.Ack,
+		patches:   options.Patches,
+		sendState: options.State,
+		verbose:   m.verbose,
+		mux:       m,
+	}
+	if h.upstream != nil && h.upstream.rate > 0 {
+		sub.limiter = newRateLimiter(h.upstream.rate)
+	}
+	m.subscriptions[key] = sub
+	m.lock.Unlock()
+
+	if confirmation != nil {
+		m.reply(confirmation)
+	}
+
+	select {
+	case h.register <- sub:
+	case <-h.closed:
+		// The center is gone in the meantime, the forwarder reports it.
+		sub.closeCode = h.closeCode
+		close(sub.send)
+	}
+
+	go m.forward(key, sub)
+
+	return nil
+}
+
+// Sends a frame through the writer.
+func (m *muxConnection) reply(frame interface{}) {
+	select {
+	case m.out <- muxOutgoing{frame: frame}:
+	case <-m.done:
+	}
+}
+
+// Removes the subscription from its hub. The forwarder reports the end of the subscription when the hub lets it go.
+func (m *muxConnection) unsubscribe(key string) bool {
+	m.lock.Lock()
+	sub, ok := m.subscriptions[key]
+	delete(m.subscriptions, key)
+	m.lock.Unlock()
+
+	if ok {
+		select {
+		case sub.hub.unregister <- sub:
+		case <-sub.hub.closed:
+		}
+	}
+
+	return ok
+}
+
+func (m *muxConnection) subscription(key string) *wsconnection {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.subscriptions[key]
+}
+
+// Returns a subscription to a center, or nil if the connection is not subscribed to it.
+func (m *muxConnection) subscriptionOf(centername string) *wsconnection {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, sub := range m.subscriptions {
+		if sub.hub.name == centername {
+			return sub
+		}
+	}
+
+	return nil
+}
+
+func (m *muxConnection) forward(key string, sub *wsconnection) {
+	for {
+		var message *hubMessage
+		var ok bool
+		select {
+		case message, ok = <-sub.send:
+		case <-m.done:
+			return
+		}
+
+		if !ok {
+			// The hub closed the subscription.
+			m.lock.Lock()
+			if m.subscriptions[key] == sub {
+				delete(m.subscriptions, key)
+			}
+			m.lock.Unlock()
+
+			select {
+			case m.out <- muxOutgoing{key: key, sub: sub}:
+			case <-m.done:
+			}
+
+			if sub.closeCode == closeGoingAway {
+				m.close(closeGoingAway)
+			}
+			return
+		}
+
+		select {
+		case m.out <- muxOutgoing{key: key, sub: sub, message: message}:
+		case <-m.done:
+			sub.countDropped(message)
+			return
+		}
+	}
+}
+
+// Makes the writer close the connection. A code of 0 means that the client is already gone.
+func (m *muxConnection) close(code int) {
+	select {
+	case m.quit <- code:
+	default:
+	}
+}
+
+// Removes every subscription from the hubs. Called when the connection is closed.
+func (m *muxConnection) closeSubscriptions() {
+	close(m.done)
+
+	m.lock.Lock()
+	subscriptions := m.subscriptions
+	m.subscriptions = make(map[string]*wsconnection)
+	m.lock.Unlock()
+
+	for _, sub := range subscriptions {
+		select {
+		case sub.hub.unregister <- sub:
+		case <-sub.hub.closed:
+		}
+	}
+}
+
+// The payload of a message for a subscription.
+func (m *muxConnection) payload(sub *wsconnection, message *hubMessage) string {
+	if sub.patches && message.patch != "" {
+		return message.patch
+	}
+
+	return message.data
+}
+
+// Runs the writer loop. The send function writes the frame of a message or of the end of a subscription, and
+// returns false if the connection is broken.
+func (m *muxConnection) run(pingInterval time.Duration, send func(out muxOutgoing) bool) {
+	defer func() {
+		m.closeSubscriptions()
+		m.conn.Close()
+	}()
+
+	var ping <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case <-ping:
+			var err error
+			if m.heartbeat != "" {
+				err = websocket.Message.Send(m.conn, m.heartbeat)
+			} else {
+				err = writePing(m.conn)
+			}
+			if err != nil {
+				return
+			}
+		case out := <-m.out:
+			if !m.write(out, send) {
+				return
+			}
+		case code := <-m.quit:
+			if code != 0 && m.flush(send) {
+				writeClose(m.conn, code)
+			}
+			return
+		case <-m.goingAway:
+			if m.flush(send) {
+				writeClose(m.conn, closeGoingAway)
+			}
+			return
+		}
+	}
+}
+
+// Returns false if the connection is broken or closed by the frame.
+func (m *muxConnection) write(out muxOutgoing, send func(out muxOutgoing) bool) bool {
+	if out.sub != nil && out.message != nil && out.message.expired() {
+		out.sub.countDropped(out.message)
+		return true
+	}
+	if !send(out) {
+		if out.sub != nil && out.message != nil {
+			out.sub.countDropped(out.message)
+		}
+		return false
+	}
+	if out.sub != nil && out.message != nil && out.message.report != nil {
+		atomic.AddInt64(&out.message.report.delivered, 1)
+	}
+
+	return true
+}
+
+// Sends the frames which are already queued, before the connection is closed. Returns false if the connection is
+// broken or closed by a frame.
+func (m *muxConnection) flush(send func(out muxOutgoing) bool) bool {
+	for {
+		select {
+		case out := <-m.out:
+			if !m.write(out, send) {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// Frame of the gopush-mux protocol sent by the client.
+type muxRequest struct {
+	Action  string `json:"action"` // subscribe, unsubscribe or send
+	Center  string `json:"center"`
+	Message string `json:"message"`
+	State   *bool  `json:"state"`
+	Patches *bool  `json:"patches"`
+	Ack     string `json:"ack"`
+}
+
+// Frame of the gopush-mux protocol sent by the server. A message has a center and a message, an event has a center
+// and an event (subscribed, unsubscribed, error).
+type muxResponse struct {
+	Center  string  `json:"center"`
+	ID      string  `json:"id,omitempty"`
+	Message *string `json:"message,omitempty"`
+	Event   string  `json:"event,omitempty"`
+	Code    int     `json:"code,omitempty"`
+	Reason  string  `json:"reason,omitempty"`
+}
+
+func (svc *GoPushService) muxHandler(conn *websocket.Conn, options listenOptions) {
+	m := newMuxConnection(conn, options, svc.config, svc.goingAway)
+
+	go m.muxReader(svc)
+	m.run(time.Duration(svc.config.PingInterval)*time.Second, func(out muxOutgoing) bool {
+		if out.sub == nil {
+			return m.sendJSON(out.frame) == nil
+		}
+
+		r := muxResponse{Center: out.key}
+		if out.message == nil {
+			r.Event = "unsubscribed"
+			r.Code = out.sub.closeCode
+			r.Reason = closeReasons[r.Code]
+		} else {
+			payload := m.payload(out.sub, out.message)
+			r.Message = &payload
+			if out.sub.ack {
+				r.ID = out.message.id()
+			}
+		}
+
+		// The client might acknowledge the message before the send returns.
+		acked := out.message != nil && out.sub.ack && out.message.report != nil
+		if acked {
+			m.acks.add(out.message.report)
+		}
+		if err := m.sendJSON(r); err != nil {
+			if acked {
+				m.acks.remove(out.message.report.id)
+			}
+			return false
+		}
+
+		return true
+	})
+}
+
+func (m *muxConnection) sendJSON(v interface{}) error {
+	marshaled, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err.Error())
+		return nil
+	}
+
+	return websocket.Message.Send(m.conn, string(marshaled))
+}
+
+func (m *muxConnection) muxReader(svc *GoPushService) {
+	defer m.close(0)
+
+	for {
+		var message string
+		if err := websocket.Message.Receive(m.conn, &message); err != nil {
+			return
+		}
+
+		if m.options.Heartbeat && message == heartbeatMessage {
+			continue
+		}
+
+		var r muxRequest
+		if err := json.Unmarshal([]byte(message), &r); err != nil {
+			m.reply(muxResponse{Event: "error", Reason: "invalid frame"})
+			continue
+		}
+
+		if r.Ack != "" {
+			m.acks.ack(r.Ack)
+			continue
+		}
+
+		switch r.Action {
+		case "subscribe":
+			hub, ok := svc.getHub(r.Center)
+			if !ok || r.Center == "" {
+				m.reply(muxResponse{Center: r.Center, Event: "error", Code: closeUnknownCenter, Reason: closeReasons[closeUnknownCenter]})
+				continue
+			}
+			if !hub.allowOrigin(connectionOrigin(m.conn)) {
+				m.reply(muxResponse{Center: r.Center, Event: "error", Code: closeUnauthorized, Reason: closeReasons[closeUnauthorized]})
+				continue
+			}
+
+			options := subscriptionOptions{
+				State:   boolOption(r.State, m.options.State == "1" || m.options.State == "" && hub.sendState),
+				Patches: boolOption(r.Patches, m.options.Patches),
+				Ack:     m.options.Ack,
+			}
+			if err := m.subscribe(r.Center, hub, options, muxResponse{Center: r.Center, Event: "subscribed"}); err != nil {
+				m.reply(muxResponse{Center: r.Center, Event: "error", Reason: err.Error()})
+				continue
+			}
+		case "unsubscribe":
+			if !m.unsubscribe(r.Center) {
+				m.reply(muxResponse{Center: r.Center, Event: "error", Reason: "not subscribed"})
+			}
+		case "send":
+			sub := m.subscription(r.Center)
+			if sub == nil {
+				m.reply(muxResponse{Center: r.Center, Event: "error", Reason: "not subscribed"})
+				continue
+			}
+			sub.hub.touch()
+			if sub.hub.upstream != nil {
+				if !sub.hub.upstream.deliver(sub, r.Message) && m.verbose {
+					log.Println("Message of a client is dropped.")
+				}
+			}
+		default:
+			m.reply(muxResponse{Center: r.Center, Event: "error", Reason: "invalid action"})
+		}
+	}
+}
+
+func boolOption(value *bool, def bool) bool {
+	if value == nil {
+		return def
+	}
+
+	return *value
+}
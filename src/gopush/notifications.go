@@ -5,10 +5,14 @@ import (
 	"crypto/rsa"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"log"
@@ -60,8 +64,27 @@ func (svc *GoPushService) handleNewCenter(w http.ResponseWriter, r *http.Request
 	mail := v.Get("mail")
 
 	newcenter := string(body)
+	if err := validateCenterID(mail, newcenter); err != nil {
+		serve400(w, err)
+		return
+	}
+
+	options, err := parseCenterOptions(v, svc.config)
+	if err != nil {
+		serve400(w, err)
+		return
+	}
 
-	centername := svc.createCenter(mail, newcenter)
+	if err := checkStoredOptions(options); err != nil {
+		serve400(w, err)
+		return
+	}
+
+	centername, err := svc.createCenter(mail, newcenter, options)
+	if err != nil {
+		serve400(w, err)
+		return
+	}
 
 	log.Printf("Created new notification center: %s\n", centername)
 
@@ -85,19 +108,123 @@ func (svc *GoPushService) handleNotify(w http.ResponseWriter, r *http.Request) {
 	v, _ := url.ParseQuery(r.URL.RawQuery)
 	mail := v.Get("mail")
 	center := v.Get("center")
-	centername := getCenterName(mail, center)
-	if _, ok := svc.lastState[centername]; !ok {
-		serve404(w)
+	centername := svc.lookupCenter(mail, center)
+
+	deliverAt, err := parseDeliveryTime(v)
+	if err != nil {
+		serve400(w, err)
 		return
 	}
 
-	newmessage := string(body)
+	ttl, err := parseTTL(v)
+	if err != nil {
+		serve400(w, err)
+		return
+	}
 
-	svc.lastState[centername] = newmessage
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		c, ok := svc.getCenter(centername)
+		if !ok {
+			serve404(w)
+			return
+		}
 
-	svc.hubs[centername].broadcast <- newmessage
+		svc.handleIdempotent(w, c, key, func(w http.ResponseWriter) {
+			svc.doNotify(w, mail, center, string(body), deliverAt, ttl)
+		})
+		return
+	}
 
+	svc.doNotify(w, mail, center, string(body), deliverAt, ttl)
+}
+
+func (svc *GoPushService) doNotify(w http.ResponseWriter, mail, center, message string, deliverAt time.Time, ttl time.Duration) {
+	centername := svc.lookupCenter(mail, center)
+
+	if deliverAt.After(time.Now()) {
+		if _, ok := svc.getCenter(centername); !ok {
+			serve404(w)
+			return
+		}
+
+		id, err := svc.scheduleNotification(mail, center, message, deliverAt, ttl)
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+
+		serveScheduled(w, id)
+		return
+	}
+
+	id, err := svc.notify(centername, message, ttl)
+	if err == errCenterNotFound {
+		serve404(w)
+		return
+	}
+	if err != nil {
+		serve400(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, id)
+}
+
+// Sends a message to the listeners of a notification center, and returns the ID of the message. In a document
+// center the message is a patch of the state. A TTL of zero means that the message does not expire.
+func (svc *GoPushService) notify(centername, message string, ttl time.Duration) (string, error) {
+	// The presence centers are not among the centers, only their own center publishes to them.
+	c, ok := svc.getCenter(centername)
+	if !ok {
+		return "", errCenterNotFound
+	}
+	hub, ok := svc.getHub(centername)
+	if !ok {
+		return "", errCenterNotFound
+	}
+
+	// The state of a document center is read and written by the notification, and the broadcasts have to be in
+	// the same order as the changes of the state.
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	m := &hubMessage{data: message}
+	if c.options.Document != "" {
+		state, _ := svc.getState(centername)
+		document, err := applyPatch(c.options.Document, state, message)
+		if err != nil {
+			return "", err
+		}
+		m = &hubMessage{data: document, patch: message}
+	}
+
+	c.touch()
+	atomic.StoreInt64(&c.lastNotify, time.Now().Unix())
+
+	m.report = svc.reports.create(c.mail, centername)
+	svc.setStateExpiry(c, centername, m, ttl)
+
+	svc.setState(centername, m.data)
+	svc.saveState(centername, m)
+
+	// The center might be removed in the meantime.
+	if !hub.post(m) {
+		return "", errCenterNotFound
+	}
+	svc.publishNotification(centername, m)
+
+	return m.id(), nil
+}
+
+// Returns the HTTP status code of a failed notification.
+func notifyErrorStatus(err error) int {
+	if err == errCenterNotFound {
+		return http.StatusNotFound
+	}
+
+	return http.StatusBadRequest
 }
 
 func (svc *GoPushService) handleRemoveCenter(w http.ResponseWriter, r *http.Request) {
@@ -115,44 +242,369 @@ func (svc *GoPushService) handleRemoveCenter(w http.ResponseWriter, r *http.Requ
 	v, _ := url.ParseQuery(r.URL.RawQuery)
 	mail := v.Get("mail")
 	center := string(body)
-	centername := getCenterName(mail, center)
-	if _, ok := svc.lastState[centername]; !ok {
+	centername := svc.lookupCenter(mail, center)
+	if _, ok := svc.getState(centername); !ok {
 		serve404(w)
 		return
 	}
 
 	log.Printf("Removed notification center: %s\n", centername)
 
-	svc.removeCenter(mail, center)
+	svc.removeCenter(mail, center, closeCenterRemoved)
 
 	w.WriteHeader(http.StatusOK)
 }
 
+var (
+	errCenterNotFound  = errors.New("Not Found")
+	errInvalidCenterID = errors.New("Invalid notification center identifier.")
+	errCenterIDTooLong = errors.New("Notification center identifier is too long.")
+)
+
+// The names of the centers are saved in varchar(255) columns.
+const maxCenterNameLength = 255
+
+// Separates the mail and the center identifier in the names of the centers, and the name of a center and the
+// presence suffix in the names of the presence centers.
+const centerNameSeparator = "____"
+
 func getCenterName(mail, center string) string {
-	return mail + "____" + center
+	return mail + centerNameSeparator + center
 }
 
-func (svc *GoPushService) createCenter(mail, center string) string {
-	centername := getCenterName(mail, center)
-	svc.lastState[centername] = ""
-	svc.hubs[centername] = newWSHub(svc.config.BroadcastBuffer)
-	svc.hubs[centername].verbose = svc.config.ExtraLogging
-	go svc.hubs[centername].run()
-	if svc.config.Timeout > 0 {
-		go func() {
-			time.Sleep(time.Duration(svc.config.Timeout) * time.Second)
-			if _, ok := svc.hubs[centername]; ok {
-				svc.removeCenter(mail, center)
-			}
-		}()
+// The separator is reserved, so a center can't take the name of a presence center.
+func validateCenterID(mail, center string) error {
+	if strings.Contains(center, centerNameSeparator) {
+		return errInvalidCenterID
+	}
+
+	if len(getCenterName(mail, center)) > maxCenterNameLength {
+		return errCenterIDTooLong
 	}
 
-	return centername
+	return nil
 }
 
-func (svc *GoPushService) removeCenter(mail, center string) {
+// Returns the public name of a center of a publisher.
+func (svc *GoPushService) lookupCenter(mail, center string) string {
+	svc.centersLock.RLock()
+	defer svc.centersLock.RUnlock()
+
+	return svc.lookupCenterLocked(mail, center)
+}
+
+// The caller must hold centersLock.
+func (svc *GoPushService) lookupCenterLocked(mail, center string) string {
+	if centername, ok := svc.centerNames[getCenterName(mail, center)]; ok {
+		return centername
+	}
+
+	return getCenterName(mail, center)
+}
+
+func (svc *GoPushService) getCenter(centername string) (*notificationCenter, bool) {
+	svc.centersLock.RLock()
+	defer svc.centersLock.RUnlock()
+
+	c, ok := svc.centers[centername]
+	return c, ok
+}
+
+func (svc *GoPushService) getHub(centername string) (*wshub, bool) {
+	svc.centersLock.RLock()
+	defer svc.centersLock.RUnlock()
+
+	hub, ok := svc.hubs[centername]
+	return hub, ok
+}
+
+// Returns the last state of a center, and false if there is no such center.
+func (svc *GoPushService) getState(centername string) (string, bool) {
+	svc.centersLock.RLock()
+	defer svc.centersLock.RUnlock()
+
+	state, ok := svc.lastState[centername]
+	return state, ok
+}
+
+// Changes the last state of a center, unless the center was removed in the meantime.
+func (svc *GoPushService) setState(centername, state string) {
+	svc.centersLock.Lock()
+	defer svc.centersLock.Unlock()
+
+	if _, ok := svc.lastState[centername]; ok {
+		svc.lastState[centername] = state
+	}
+}
+
+type centerOptions struct {
+	Presence       bool
+	Upstream       string
+	UpstreamSecret string
+	DefaultState   string
+	Tombstone      bool
+	Policy         string
+	SendBuffer     int64
+	// Seconds. Lifetime is -1 if the global timeout applies, and 0 if the center never expires.
+	Lifetime    int64
+	IdleTimeout int64
+	Description string
+	// The public name of the center is a random identifier instead of the mail and the center identifier.
+	Opaque bool
+	// Patch format of a document center, empty if the state is not a JSON document.
+	Document string
+	// New listeners get the current state as the first message.
+	SendState bool
+	// The origins of the pages which may register push subscriptions. Nobody can, if it is empty.
+	WebPushOrigins []string `json:",omitempty"`
+	// The origins of the pages which may listen. Anybody can, if it is empty.
+	ListenOrigins []string `json:",omitempty"`
+	// Added after the center is created. The push subscriptions are saved separately in the backend.
+	Webhooks []webhookOptions
+	WebPush  []webPushSubscription `json:",omitempty"`
+}
+
+func parseCenterOptions(v url.Values, config Config) (centerOptions, error) {
+	sendbuffer, err := parseSendBuffer(v)
+	if err != nil {
+		return centerOptions{}, err
+	}
+
+	policy := v.Get("policy")
+	if err := validatePolicy(policy); err != nil {
+		return centerOptions{}, err
+	}
+
+	lifetime, err := parseExpiry(v, "lifetime")
+	if err != nil {
+		return centerOptions{}, err
+	}
+
+	idletimeout, err := parseExpiry(v, "idletimeout")
+	if err != nil {
+		return centerOptions{}, err
+	}
+	if idletimeout < 0 {
+		idletimeout = 0
+	}
+
+	document := v.Get("document")
+	if err := validateDocumentFormat(document); err != nil {
+		return centerOptions{}, err
+	}
+
+	defaultState := v.Get("default")
+	if document != "" {
+		if defaultState == "" {
+			defaultState = "{}"
+		}
+		if _, err := decodeJSON(defaultState); err != nil {
+			return centerOptions{}, errInvalidDocument
+		}
+	}
+
+	return centerOptions{
+		Presence:       v.Get("presence") != "",
+		Upstream:       v.Get("upstream"),
+		UpstreamSecret: v.Get("upstreamsecret"),
+		DefaultState:   defaultState,
+		Tombstone:      v.Get("tombstone") != "",
+		Policy:         policy,
+		SendBuffer:     sendbuffer,
+		Lifetime:       lifetime,
+		IdleTimeout:    idletimeout,
+		Description:    v.Get("description"),
+		Opaque:         config.OpaqueCenterNames && v.Get("opaque") != "0" || v.Get("opaque") == "1",
+		Document:       document,
+		SendState:      v.Get("sendstate") != "",
+		WebPushOrigins: v["webpushorigin"],
+		ListenOrigins:  v["listenorigin"],
+	}, nil
+}
+
+type notificationCenter struct {
+	mail    string
+	center  string
+	options centerOptions
+	created int64
+	// Unix timestamp, updated concurrently by the notifications.
+	lastNotify int64
+	// The last message and the timer which resets the state when its TTL expires.
+	last   *hubMessage
+	expiry *time.Timer
+	// Results of the notifications sent with an idempotency key.
+	idempotency map[string]*idempotentResult
+	// Timers which remove the center.
+	lifetimeTimer *time.Timer
+	idleTimer     *time.Timer
+	idleTimeout   time.Duration
+	sharedTouch   time.Time // The last listener activity told to the other nodes.
+	expiryLock    sync.Mutex
+	stateLock     sync.Mutex
+	// The running webhooks by their identifiers, and the sender of the push subscriptions. Nil if there are none.
+	// The lock also guards the webhooks and the push subscriptions of the options, and the rate of the subscriptions.
+	webhooks    map[string]*webhook
+	webPush     *webPushSender
+	pushLimiter *rateLimiter
+	webhookLock sync.Mutex
+}
+
+func (svc *GoPushService) newHub(centername string) *wshub {
+	h := newWSHub(svc.config.BroadcastBuffer)
+	h.name = centername
+	h.verbose = svc.config.ExtraLogging
+	if svc.config.SendBuffer > 0 {
+		h.sendBuffer = svc.config.SendBuffer
+	}
+
+	return h
+}
+
+func (svc *GoPushService) createCenter(mail, center string, options centerOptions) (string, error) {
 	centername := getCenterName(mail, center)
+	if options.Opaque {
+		centername = svc.opaqueCenterName(mail, center)
+	}
+
+	up, err := svc.newCenterUpstream(centername, options)
+	if err != nil {
+		return "", err
+	}
+	// The stored centers are not checked again when they are opened, their requests are checked when they connect.
+	if up != nil && up.url.Scheme != "unix" {
+		if err := checkDestination(options.Upstream, svc.config); err != nil {
+			return "", err
+		}
+	}
+
+	// Recreating a center replaces the old one.
+	if _, ok := svc.getCenter(svc.lookupCenter(mail, center)); ok {
+		svc.removeCenter(mail, center, closeCenterRemoved)
+	}
+
+	c := &notificationCenter{
+		mail:    mail,
+		center:  center,
+		options: options,
+		created: time.Now().Unix(),
+	}
+	svc.openCenter(c, centername, options.DefaultState, up)
+	svc.saveCenter(c, centername)
+	svc.publishCenter(c, centername)
+
+	return centername, nil
+}
+
+func (svc *GoPushService) newCenterUpstream(centername string, options centerOptions) (*upstream, error) {
+	if options.Upstream == "" {
+		return nil, nil
+	}
+
+	return newUpstream(centername, options.Upstream, options.UpstreamSecret, svc.config)
+}
+
+// Registers the center and starts its hubs and timers. A center which is still open with the same mail and
+// identifier is replaced.
+func (svc *GoPushService) openCenter(c *notificationCenter, centername, state string, up *upstream) {
+	options := c.options
+	hub := svc.newHub(centername)
+	hub.reports = svc.reports
+	if options.Policy != "" {
+		hub.policy = options.Policy
+	}
+	if options.SendBuffer > 0 {
+		hub.sendBuffer = options.SendBuffer
+	}
+	hub.activity = func() { svc.listenerActivity(c, centername) }
+	hub.state = &hubMessage{data: state}
+	hub.sendState = options.SendState
+	hub.document = options.Document
+	hub.upstream = up
+	hub.origins = options.ListenOrigins
+	if options.Presence {
+		hub.presenceHub = svc.newHub(getPresenceCenterName(centername))
+		hub.presenceHub.origins = options.ListenOrigins
+	}
+
+	svc.centersLock.Lock()
+	old, oldHubs := svc.detachCenter(c.mail, c.center)
+	svc.centerNames[getCenterName(c.mail, c.center)] = centername
+	svc.centers[centername] = c
+	svc.lastState[centername] = state
+	svc.hubs[centername] = hub
+	if hub.presenceHub != nil {
+		svc.lastState[hub.presenceHub.name] = ""
+		svc.hubs[hub.presenceHub.name] = hub.presenceHub
+	}
+	svc.centersLock.Unlock()
+
+	svc.closeCenter(old, oldHubs, closeCenterRemoved)
+
+	if up != nil {
+		go up.run()
+	}
+	if hub.presenceHub != nil {
+		go hub.presenceHub.run()
+	}
+	go hub.run()
+	svc.startWebhooks(c, centername)
+	svc.startCenterExpiry(c, c.mail, c.center)
+}
+
+// Removes a center from the backend and from every node of the cluster, and closes the connections of its
+// listeners with the given close code.
+func (svc *GoPushService) removeCenter(mail, center string, code int) {
+	centername := svc.lookupCenter(mail, center)
+	svc.forgetCenter(centername)
+	svc.dropCenter(mail, center, code)
+	svc.publish(&BackplaneEvent{Kind: eventRemoveCenter, Name: centername, Mail: mail, Center: center, Code: code})
+}
+
+// Closes a center on this node only.
+func (svc *GoPushService) dropCenter(mail, center string, code int) {
+	svc.centersLock.Lock()
+	c, hubs := svc.detachCenter(mail, center)
+	svc.centersLock.Unlock()
+
+	svc.closeCenter(c, hubs, code)
+}
+
+// Removes a center and its presence center from the maps, and returns what has to be closed. The caller must hold
+// centersLock.
+func (svc *GoPushService) detachCenter(mail, center string) (*notificationCenter, []*wshub) {
+	centername := svc.lookupCenterLocked(mail, center)
+	delete(svc.centerNames, getCenterName(mail, center))
+
+	c := svc.centers[centername]
+	delete(svc.centers, centername)
 	delete(svc.lastState, centername)
-	svc.hubs[centername].quit <- true
-	delete(svc.hubs, centername)
+
+	var hubs []*wshub
+	for _, name := range []string{centername, getPresenceCenterName(centername)} {
+		if hub, ok := svc.hubs[name]; ok {
+			hubs = append(hubs, hub)
+			delete(svc.hubs, name)
+			delete(svc.lastState, name)
+		}
+	}
+
+	return c, hubs
+}
+
+// Stops the timers of a detached center, and closes the connections of its listeners. It must not be called with
+// centersLock held, the notifications take the state lock of the center first.
+func (svc *GoPushService) closeCenter(c *notificationCenter, hubs []*wshub, code int) {
+	if c != nil {
+		c.stateLock.Lock()
+		if c.expiry != nil {
+			c.expiry.Stop()
+			c.expiry = nil
+		}
+		c.stateLock.Unlock()
+		c.stopExpiry()
+	}
+
+	for _, hub := range hubs {
+		hub.close(code)
+	}
 }
@@ -0,0 +1,182 @@
+package gopush
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"log"
+)
+
+// A notification center as it is saved in the backend.
+type StoredCenter struct {
+	Name         string // The public name of the center.
+	Mail         string
+	Center       string
+	Options      string // JSON encoded centerOptions
+	Created      int64  // Unix timestamp
+	State        string
+	StateExpires int64 // Unix timestamp, zero if the state does not expire.
+}
+
+// The options are saved in a text column.
+const maxStoredOptionsSize = 65535
+
+var errCenterOptionsTooLarge = errors.New("The options of the notification center are too large.")
+
+// The push subscriptions are not saved with the options, see savePushSubscription.
+func encodeStoredOptions(o centerOptions) ([]byte, error) {
+	o.WebPush = nil
+	return json.Marshal(o)
+}
+
+// Returns an error if the options would not fit in the backend.
+func checkStoredOptions(o centerOptions) error {
+	options, err := encodeStoredOptions(o)
+	if err != nil {
+		return err
+	}
+	if len(options) > maxStoredOptionsSize {
+		return errCenterOptionsTooLarge
+	}
+
+	return nil
+}
+
+func (svc *GoPushService) saveCenter(c *notificationCenter, centername string) {
+	options, err := encodeStoredOptions(c.options)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	state, _ := svc.getState(centername)
+	if err := svc.backend.SaveCenter(&StoredCenter{
+		Name:    centername,
+		Mail:    c.mail,
+		Center:  c.center,
+		Options: string(options),
+		Created: c.created,
+		State:   state,
+	}); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Saves the last state of a center. The message is nil when the state is reverted to the default.
+func (svc *GoPushService) saveState(centername string, m *hubMessage) {
+	state, _ := svc.getState(centername)
+
+	var expires int64
+	if m != nil && !m.expires.IsZero() {
+		expires = m.expires.Unix()
+	}
+
+	if err := svc.backend.SaveCenterState(centername, state, expires); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (svc *GoPushService) savePushSubscription(centername string, s webPushSubscription) {
+	subscription, err := json.Marshal(s)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	if err := svc.backend.SavePushSubscription(centername, s.Endpoint, string(subscription)); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Loads the push subscriptions of a restored center. The subscriptions which were saved with the options by the
+// earlier versions are moved to their own table.
+func (svc *GoPushService) restorePushSubscriptions(c *notificationCenter, centername string) {
+	for _, s := range c.options.WebPush {
+		svc.savePushSubscription(centername, s)
+	}
+	c.options.WebPush = nil
+
+	list, err := svc.backend.GetPushSubscriptions(centername)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	for _, subscription := range list {
+		var s webPushSubscription
+		if err := json.Unmarshal([]byte(subscription), &s); err != nil {
+			log.Printf("Failed to restore a push subscription of %s: %s\n", centername, err.Error())
+			continue
+		}
+		c.options.WebPush = append(c.options.WebPush, s)
+	}
+}
+
+func (svc *GoPushService) forgetCenter(centername string) {
+	if err := svc.backend.RemoveCenter(centername); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Recreates the centers saved in the backend with their last state. Centers whose lifetime ended while the server
+// was down are removed.
+func (svc *GoPushService) restoreCenters() {
+	list, err := svc.backend.GetCenters()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	restored := 0
+	for _, sc := range list {
+		// The other nodes restore their own centers.
+		if !svc.ownsCenter(getCenterName(sc.Mail, sc.Center)) {
+			continue
+		}
+
+		c := &notificationCenter{
+			mail:    sc.Mail,
+			center:  sc.Center,
+			created: sc.Created,
+		}
+
+		if err := json.Unmarshal([]byte(sc.Options), &c.options); err != nil {
+			log.Printf("Failed to restore notification center %s: %s\n", sc.Name, err.Error())
+			continue
+		}
+
+		if deadline := svc.centerDeadline(c); !deadline.IsZero() && !deadline.After(time.Now()) {
+			log.Printf("Notification center expired (lifetime): %s\n", sc.Name)
+			svc.forgetCenter(sc.Name)
+			continue
+		}
+
+		svc.restorePushSubscriptions(c, sc.Name)
+
+		up, err := svc.newCenterUpstream(sc.Name, c.options)
+		if err != nil {
+			log.Printf("Failed to restore notification center %s: %s\n", sc.Name, err.Error())
+			continue
+		}
+
+		expires := time.Unix(sc.StateExpires, 0)
+		if sc.StateExpires > 0 && !expires.After(time.Now()) {
+			svc.openCenter(c, sc.Name, c.options.DefaultState, up)
+			svc.saveState(sc.Name, nil)
+		} else {
+			svc.openCenter(c, sc.Name, sc.State, up)
+			if sc.StateExpires > 0 {
+				c.stateLock.Lock()
+				svc.setStateExpiry(c, sc.Name, &hubMessage{data: sc.State}, expires.Sub(time.Now()))
+				c.stateLock.Unlock()
+			}
+		}
+
+		restored++
+	}
+
+	if restored > 0 {
+		log.Printf("Restored %d notification center(s).\n", restored)
+	}
+}
@@ -17,19 +17,24 @@ func (svc *GoPushService) handlePing(w http.ResponseWriter, r *http.Request) {
 	center := v.Get("center")
 	callback := v.Get("callback") // For JSONP
 
-	if _, ok := svc.lastState[center]; center == "" || !ok {
+	state, ok := svc.getState(center)
+	if center == "" || !ok {
 		serve404(w)
 		return
 	}
 
 	if callback == "" { // Normal response
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if c, ok := svc.getCenter(center); ok && c.options.Document != "" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
 		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, svc.lastState[center])
+		io.WriteString(w, state)
 	} else { // JSONP response
 		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
-		marshaled, _ := json.Marshal(svc.lastState[center])
+		marshaled, _ := json.Marshal(state)
 		io.WriteString(w, callback+"("+string(marshaled)+");")
 	}
 }
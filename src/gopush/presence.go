@@ -0,0 +1,121 @@
+package gopush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"log"
+)
+
+type hubPresence struct {
+	Listeners   int      `json:"listeners"`
+	Subscribers []string `json:"subscribers,omitempty"`
+}
+
+type presenceEvent struct {
+	Event     string `json:"event"`
+	ID        string `json:"id,omitempty"`
+	Listeners int    `json:"listeners"`
+}
+
+func getPresenceCenterName(centername string) string {
+	return centername + centerNameSeparator + "presence"
+}
+
+// The webhooks and the push senders are not listeners. Must be called from the hub's goroutine.
+func (h *wshub) getPresence() hubPresence {
+	var p hubPresence
+	for c := range h.connections {
+		if c.internal {
+			continue
+		}
+		p.Listeners++
+		if c.id != "" {
+			p.Subscribers = append(p.Subscribers, c.id)
+		}
+	}
+
+	return p
+}
+
+// Must be called from the hub's goroutine.
+func (h *wshub) publishPresence(event string, c *wsconnection) {
+	if h.presenceHub == nil || c.internal {
+		return
+	}
+
+	marshaled, err := json.Marshal(presenceEvent{
+		Event:     event,
+		ID:        c.id,
+		Listeners: h.getPresence().Listeners,
+	})
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	// Presence events are not worth blocking the hub for.
+	select {
+	case h.presenceHub.broadcast <- &hubMessage{data: string(marshaled)}:
+	default:
+		if h.verbose {
+			log.Println("Presence event dropped, the broadcast buffer is full.")
+		}
+	}
+}
+
+// Asks the hub's goroutine for the presence information. Returns false if the hub is closed.
+func (h *wshub) queryPresence() (hubPresence, bool) {
+	req := make(chan hubPresence, 1)
+	select {
+	case h.presence <- req:
+	case <-h.closed:
+		return hubPresence{}, false
+	}
+
+	return <-req, true
+}
+
+func (svc *GoPushService) handlePresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+	centername := svc.lookupCenter(mail, string(body))
+	hub, ok := svc.getHub(centername)
+	if !ok {
+		serve404(w)
+		return
+	}
+
+	p, ok := hub.queryPresence()
+	if !ok {
+		serve404(w)
+		return
+	}
+
+	if v.Get("subscribers") == "" {
+		p.Subscribers = nil
+	}
+
+	marshaled, err := json.Marshal(p)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaled)
+}
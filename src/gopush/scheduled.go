@@ -0,0 +1,253 @@
+package gopush
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"log"
+)
+
+var errInvalidDeliveryTime = errors.New("Invalid deliver_at or delay parameter.")
+
+type ScheduledNotification struct {
+	ID        string `json:"id"`
+	Mail      string `json:"-"`
+	Center    string `json:"center"`
+	Message   string `json:"message"`
+	DeliverAt int64  `json:"deliver_at"` // Unix timestamp
+	TTL       int64  `json:"ttl"`        // Seconds
+}
+
+type scheduledDelivery struct {
+	notification ScheduledNotification
+	timer        *time.Timer
+}
+
+// Returns the time of the delivery from the deliver_at (unix timestamp or RFC 3339) or delay (seconds) parameters.
+// The zero time means immediate delivery.
+func parseDeliveryTime(v url.Values) (time.Time, error) {
+	if deliverAt := v.Get("deliver_at"); deliverAt != "" {
+		if ts, err := strconv.ParseInt(deliverAt, 10, 64); err == nil {
+			return time.Unix(ts, 0), nil
+		}
+		if t, err := time.Parse(time.RFC3339, deliverAt); err == nil {
+			return t, nil
+		}
+		return time.Time{}, errInvalidDeliveryTime
+	}
+
+	if delay := v.Get("delay"); delay != "" {
+		seconds, err := strconv.ParseInt(delay, 10, 64)
+		if err != nil || seconds < 0 {
+			return time.Time{}, errInvalidDeliveryTime
+		}
+		return time.Now().Add(time.Duration(seconds) * time.Second), nil
+	}
+
+	return time.Time{}, nil
+}
+
+func (svc *GoPushService) scheduleNotification(mail, center, message string, deliverAt time.Time, ttl time.Duration) (string, error) {
+	n := ScheduledNotification{
+		ID:        genRandomHash(64),
+		Mail:      mail,
+		Center:    center,
+		Message:   message,
+		DeliverAt: deliverAt.Unix(),
+		TTL:       int64(ttl / time.Second),
+	}
+
+	if err := svc.backend.AddScheduled(&n); err != nil {
+		return "", err
+	}
+
+	svc.startScheduled(n)
+
+	return n.ID, nil
+}
+
+func (svc *GoPushService) startScheduled(n ScheduledNotification) {
+	svc.scheduledLock.Lock()
+	defer svc.scheduledLock.Unlock()
+
+	delay := time.Unix(n.DeliverAt, 0).Sub(time.Now())
+	svc.scheduled[n.ID] = &scheduledDelivery{
+		notification: n,
+		timer: time.AfterFunc(delay, func() {
+			svc.deliverScheduled(n.ID)
+		}),
+	}
+}
+
+func (svc *GoPushService) deliverScheduled(id string) {
+	svc.scheduledLock.Lock()
+	d, ok := svc.scheduled[id]
+	delete(svc.scheduled, id)
+	svc.scheduledLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// The node which received the notification has a timer for it, and so has every node which restored it at its
+	// start. The one which removes it from the backend delivers it. Another node, or a cancellation, got there first.
+	removed, err := svc.backend.RemoveScheduled(id)
+	if err != nil {
+		log.Printf("Scheduled notification %s is dropped: %s\n", id, err.Error())
+		return
+	}
+	if !removed {
+		return
+	}
+
+	if _, err := svc.notify(svc.lookupCenter(d.notification.Mail, d.notification.Center), d.notification.Message, time.Duration(d.notification.TTL)*time.Second); err != nil {
+		log.Printf("Scheduled notification %s is dropped: %s\n", id, err.Error())
+	}
+}
+
+// Returns false if there is no pending notification with this ID for the user. The notification is removed from the
+// backend, so any node of a cluster can cancel it, and the timers which fire later don't deliver it.
+func (svc *GoPushService) cancelScheduled(mail, id string) (bool, error) {
+	// The notification might be delivered in the meantime.
+	removed, err := svc.backend.CancelScheduled(mail, id)
+	if err != nil || !removed {
+		return false, err
+	}
+
+	svc.scheduledLock.Lock()
+	if d, ok := svc.scheduled[id]; ok {
+		d.timer.Stop()
+		delete(svc.scheduled, id)
+	}
+	svc.scheduledLock.Unlock()
+
+	return true, nil
+}
+
+// Returns the pending notifications of the user from the backend, so every node of a cluster sees the same list.
+func (svc *GoPushService) listScheduled(mail string) ([]ScheduledNotification, error) {
+	list, err := svc.backend.GetUserScheduled(mail)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []ScheduledNotification{}
+	}
+
+	sort.Sort(scheduledByTime(list))
+
+	return list, nil
+}
+
+// Restarts the timers of the notifications saved in the backend. Overdue notifications are delivered immediately.
+func (svc *GoPushService) restoreScheduled() {
+	list, err := svc.backend.GetScheduled()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	restored := 0
+	for _, n := range list {
+		if !svc.ownsCenter(getCenterName(n.Mail, n.Center)) {
+			continue
+		}
+		svc.startScheduled(n)
+		restored++
+	}
+
+	if restored > 0 {
+		log.Printf("Restored %d scheduled notification(s).\n", restored)
+	}
+}
+
+// Stops the timers, but keeps the notifications in the backend for the next start.
+func (svc *GoPushService) stopScheduled() {
+	svc.scheduledLock.Lock()
+	defer svc.scheduledLock.Unlock()
+
+	for id, d := range svc.scheduled {
+		d.timer.Stop()
+		delete(svc.scheduled, id)
+	}
+}
+
+type scheduledByTime []ScheduledNotification
+
+func (s scheduledByTime) Len() int           { return len(s) }
+func (s scheduledByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s scheduledByTime) Less(i, j int) bool { return s[i].DeliverAt < s[j].DeliverAt }
+
+func (svc *GoPushService) handleScheduled(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+
+	list, err := svc.listScheduled(mail)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	marshaled, err := json.Marshal(list)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaled)
+}
+
+func (svc *GoPushService) handleCancelScheduled(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+
+	found, err := svc.cancelScheduled(mail, string(body))
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	if !found {
+		serve404(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func serveScheduled(w http.ResponseWriter, id string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, id)
+}
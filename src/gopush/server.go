@@ -6,6 +6,14 @@ import (
 	"net/http"
 )
 
+func serve400(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	io.WriteString(w, "Bad Request")
+	io.WriteString(w, "\n")
+	io.WriteString(w, err.Error())
+}
+
 func serve404(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusNotFound)
@@ -30,6 +38,12 @@ func serve403(w http.ResponseWriter) {
 	io.WriteString(w, "Forbidden")
 }
 
+func serve429(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	io.WriteString(w, "Too Many Requests")
+}
+
 func serveError(w http.ResponseWriter, err error) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusInternalServerError)
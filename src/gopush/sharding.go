@@ -0,0 +1,271 @@
+package gopush
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+
+	"log"
+)
+
+// How the requests of the centers of other nodes are handled.
+const (
+	routingRedirect = "redirect" // HTTP 307, or the 4005 close code with the address of the owner for the websockets.
+	routingProxy    = "proxy"    // The request is forwarded to the owner.
+)
+
+// Points of every peer on the hash ring. More points spread the centers more evenly.
+const hashRingReplicas = 128
+
+// Marks the requests forwarded by another node. They are always served locally, so a request can't go around
+// between nodes which disagree about the owner.
+const forwardedHeader = "X-GoPush-Forwarded"
+
+// Time limit of the requests sent to every peer.
+const fanOutTimeout = 10 * time.Second
+
+var errInvalidPeers = errors.New("Invalid peers configuration. Peerurl must be one of the peers, and peerrouting must be redirect or proxy.")
+
+// Consistent hashing of the center names over the peers. Adding or removing a peer moves only the centers of
+// its part of the ring.
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func hashRingPoint(key string) uint32 {
+	digest := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint32(digest[:4])
+}
+
+func newHashRing(peers []string) *hashRing {
+	r := &hashRing{owners: make(map[uint32]string)}
+	for _, peer := range peers {
+		for i := 0; i < hashRingReplicas; i++ {
+			point := hashRingPoint(peer + "#" + strconv.Itoa(i))
+			r.points = append(r.points, point)
+			r.owners[point] = peer
+		}
+	}
+	sort.Sort(uint32Slice(r.points))
+
+	return r
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+
+func (r *hashRing) owner(key string) string {
+	point := hashRingPoint(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
+
+// Sets up the sharding of the centers if peers are configured.
+func (svc *GoPushService) initSharding() error {
+	if len(svc.config.Peers) == 0 {
+		return nil
+	}
+
+	routing := svc.config.PeerRouting
+	if routing == "" {
+		routing = routingRedirect
+	}
+	if routing != routingRedirect && routing != routingProxy {
+		return errInvalidPeers
+	}
+
+	proxies := make(map[string]*httputil.ReverseProxy)
+	self := false
+	for _, peer := range svc.config.Peers {
+		target, err := url.Parse(peer)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return errInvalidPeers
+		}
+		if peer == svc.config.PeerURL {
+			self = true
+			continue
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			r.Header.Set(forwardedHeader, svc.config.PeerURL)
+		}
+		proxies[peer] = proxy
+	}
+	if !self {
+		return errInvalidPeers
+	}
+
+	svc.ring = newHashRing(svc.config.Peers)
+	svc.routing = routing
+	svc.proxies = proxies
+	log.Printf("Sharding the notification centers over %d node(s).\n", len(svc.config.Peers))
+
+	return nil
+}
+
+// Returns true if this node serves the center. The key is the name of the center from the mail and the center
+// identifier, or its public name.
+func (svc *GoPushService) ownsCenter(key string) bool {
+	return svc.ring == nil || svc.ring.owner(key) == svc.config.PeerURL
+}
+
+// The public name of an opaque center is picked to have the same owner as its mail and identifier, so both the
+// publisher and the listeners find it on the same node.
+func (svc *GoPushService) opaqueCenterName(mail, center string) string {
+	for {
+		centername := genRandomHash(64)
+		if svc.ring == nil || svc.ring.owner(centername) == svc.ring.owner(getCenterName(mail, center)) {
+			return centername
+		}
+	}
+}
+
+// Routing keys of the requests. An empty key means that the request is served locally.
+
+func routeByPublicName(r *http.Request) string {
+	centername := r.URL.Query().Get("center")
+	// The presence center is on the node of its center.
+	return strings.TrimSuffix(centername, getPresenceCenterName(""))
+}
+
+func routeByQuery(r *http.Request) string {
+	v := r.URL.Query()
+	if v.Get("center") == "" {
+		return ""
+	}
+
+	return getCenterName(v.Get("mail"), v.Get("center"))
+}
+
+// The body of the manager APIs is the center identifier. It is read here, and put back for the handler.
+func routeByBody(r *http.Request) string {
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return getCenterName(r.URL.Query().Get("mail"), string(body))
+}
+
+// Serves the request if this node owns the center, and sends it to the owner otherwise.
+func (svc *GoPushService) routed(key func(r *http.Request) string, h http.Handler) http.Handler {
+	if svc.ring == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k := key(r)
+		if k == "" || r.Header.Get(forwardedHeader) != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		owner := svc.ring.owner(k)
+		if owner == svc.config.PeerURL {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if svc.config.ExtraLogging {
+			log.Printf("Routing %s to %s.\n", r.URL.Path, owner)
+		}
+
+		if svc.routing == routingProxy {
+			svc.proxies[owner].ServeHTTP(w, r)
+			return
+		}
+
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			svc.redirectWebsocket(w, r, owner)
+			return
+		}
+
+		w.Header().Set("Location", owner+r.URL.RequestURI())
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	})
+}
+
+// Browsers don't follow the redirects of the websocket handshakes. The connection is accepted and closed with the
+// address of the owner in the reason, the client reconnects there with the same path.
+func (svc *GoPushService) redirectWebsocket(w http.ResponseWriter, r *http.Request, owner string) {
+	address := "ws" + strings.TrimPrefix(owner, "http")
+
+	websocket.Server{
+		Handshake: protocolHandshake(listenProtocols, true),
+		Handler: func(conn *websocket.Conn) {
+			writeCloseReason(conn, closeMoved, address)
+			conn.Close()
+		},
+	}.ServeHTTP(w, r)
+}
+
+// Sends a copy of a request which is not about a single center to the other peers, and returns the bodies of their
+// successful responses by peer. The peers which fail are left out. Returns nil if the centers are not sharded, or
+// the request was sent by another node.
+func (svc *GoPushService) fanOut(r *http.Request, body []byte) map[string][]byte {
+	if svc.ring == nil || r.Header.Get(forwardedHeader) != "" {
+		return nil
+	}
+
+	client := &http.Client{Timeout: fanOutTimeout}
+	results := make(map[string][]byte)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for peer := range svc.proxies {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+
+			req, err := http.NewRequest(r.Method, peer+r.URL.RequestURI(), bytes.NewReader(body))
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+			req.Header.Set("Authorization", r.Header.Get("Authorization"))
+			req.Header.Set(forwardedHeader, svc.config.PeerURL)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Printf("Failed to send %s to %s: %s\n", r.URL.Path, peer, err.Error())
+				return
+			}
+			defer resp.Body.Close()
+
+			respbody, err := ioutil.ReadAll(resp.Body)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				if svc.config.ExtraLogging {
+					log.Printf("%s returned status code %d for %s.\n", peer, resp.StatusCode, r.URL.Path)
+				}
+				return
+			}
+
+			lock.Lock()
+			results[peer] = respbody
+			lock.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	return results
+}
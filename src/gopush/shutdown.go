@@ -0,0 +1,66 @@
+package gopush
+
+import (
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+
+	"log"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// Counts the open websocket connections, so the shutdown can wait for their close frames. The connections which
+// arrive during the shutdown are closed right away.
+func (svc *GoPushService) tracked(handler func(conn *websocket.Conn)) func(conn *websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		svc.connectionLock.Lock()
+		if svc.stopping {
+			svc.connectionLock.Unlock()
+			writeClose(conn, closeGoingAway)
+			conn.Close()
+			return
+		}
+		svc.connections[conn] = true
+		svc.connectionGroup.Add(1)
+		svc.connectionLock.Unlock()
+
+		defer func() {
+			svc.connectionLock.Lock()
+			delete(svc.connections, conn)
+			svc.connectionLock.Unlock()
+			svc.connectionGroup.Done()
+		}()
+
+		handler(conn)
+	}
+}
+
+func (svc *GoPushService) isStopping() bool {
+	svc.connectionLock.Lock()
+	defer svc.connectionLock.Unlock()
+
+	return svc.stopping
+}
+
+// Waits until the websocket connections are closed, and cuts off the ones which are still open at the deadline.
+func (svc *GoPushService) waitConnections(deadline time.Time) {
+	closed := make(chan bool)
+	go func() {
+		svc.connectionGroup.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return
+	case <-time.After(deadline.Sub(time.Now())):
+	}
+
+	svc.connectionLock.Lock()
+	log.Printf("Closing %d connection(s) which did not finish in time.\n", len(svc.connections))
+	for conn := range svc.connections {
+		conn.Close()
+	}
+	svc.connectionLock.Unlock()
+}
@@ -0,0 +1,148 @@
+package gopush
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const defaultSendBuffer = 256
+
+// What happens when the send buffer of a connection is full.
+const (
+	policyDisconnect = "disconnect" // The connection is closed.
+	policyDropOldest = "dropoldest" // The oldest message in the buffer is dropped.
+	policyCoalesce   = "coalesce"   // The buffer is emptied, only the newest message is kept.
+)
+
+var errInvalidPolicy = errors.New("Invalid policy. Supported policies: disconnect, dropoldest, coalesce.")
+var errInvalidSendBuffer = errors.New("Invalid sendbuffer parameter.")
+
+type slowConsumerStats struct {
+	Policy        string `json:"policy"`
+	SendBuffer    int64  `json:"sendbuffer"`
+	Disconnected  int64  `json:"disconnected"`
+	DroppedOldest int64  `json:"droppedoldest"`
+	Coalesced     int64  `json:"coalesced"`
+}
+
+func validatePolicy(policy string) error {
+	switch policy {
+	case "", policyDisconnect, policyDropOldest, policyCoalesce:
+		return nil
+	}
+
+	return errInvalidPolicy
+}
+
+func parseSendBuffer(v url.Values) (int64, error) {
+	sendbuffer := v.Get("sendbuffer")
+	if sendbuffer == "" {
+		return 0, nil
+	}
+
+	size, err := strconv.ParseInt(sendbuffer, 10, 64)
+	if err != nil || size < 1 {
+		return 0, errInvalidSendBuffer
+	}
+
+	return size, nil
+}
+
+// Sends a message to the send buffer of a connection, applying the slow consumer policy of the hub if the buffer is
+// full. Must be called from the hub's goroutine.
+func (h *wshub) deliver(c *wsconnection, m *hubMessage) {
+	for {
+		select {
+		case c.send <- m:
+			return
+		default:
+		}
+
+		switch h.policy {
+		case policyDropOldest:
+			select {
+			case old := <-c.send:
+				c.countDropped(old)
+				atomic.AddInt64(&h.droppedOldest, 1)
+			default:
+			}
+		case policyCoalesce:
+			for drained := false; !drained; {
+				select {
+				case old := <-c.send:
+					c.countDropped(old)
+					atomic.AddInt64(&h.coalesced, 1)
+				default:
+					drained = true
+				}
+			}
+		default:
+			c.countDropped(m)
+			atomic.AddInt64(&h.disconnected, 1)
+			h.disconnect(c, closeTooSlow)
+			return
+		}
+	}
+}
+
+// Removes a connection from the hub, and makes its writer close it with the given close code.
+// Must be called from the hub's goroutine.
+func (h *wshub) disconnect(c *wsconnection, code int) {
+	delete(h.connections, c)
+	c.closeCode = code
+	close(c.send)
+	// Unblocks the writer if it is stuck on a client which does not read, but leaves time for the close frame. A
+	// subscription of a multiplexed connection does not own the connection, and a webhook has none.
+	if c.mux == nil && c.conn != nil {
+		c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	}
+	h.publishPresence("leave", c)
+}
+
+func (h *wshub) getSlowConsumerStats() slowConsumerStats {
+	return slowConsumerStats{
+		Policy:        h.policy,
+		SendBuffer:    h.sendBuffer,
+		Disconnected:  atomic.LoadInt64(&h.disconnected),
+		DroppedOldest: atomic.LoadInt64(&h.droppedOldest),
+		Coalesced:     atomic.LoadInt64(&h.coalesced),
+	}
+}
+
+func (svc *GoPushService) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+	centername := svc.lookupCenter(mail, string(body))
+	hub, ok := svc.getHub(centername)
+	if !ok {
+		serve404(w)
+		return
+	}
+
+	marshaled, err := json.Marshal(hub.getSlowConsumerStats())
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaled)
+}
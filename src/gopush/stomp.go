@@ -0,0 +1,444 @@
+package gopush
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+
+	"log"
+)
+
+// STOMP 1.2 over websocket. The destinations of the subscriptions are /center/$CENTERNAME.
+const stompProtocol = "v12.stomp"
+
+const stompDestinationPrefix = "/center/"
+
+const stompMaxFrameSize = 1 << 20
+
+// Room for the command and the headers of a frame, in addition to the message size limit of the upstream.
+const stompMaxHeaderSize = 8 << 10
+
+var errSTOMPMalformed = errors.New("malformed STOMP frame")
+
+type stompFrame struct {
+	command string
+	headers [][2]string
+	body    string
+	// The connection is closed with the close code after sending the frame.
+	closeCode int
+	close     bool
+}
+
+func (f *stompFrame) header(name string) string {
+	// The first occurrence of a repeated header wins.
+	for _, h := range f.headers {
+		if h[0] == name {
+			return h[1]
+		}
+	}
+
+	return ""
+}
+
+func (f *stompFrame) hasHeader(name string) bool {
+	for _, h := range f.headers {
+		if h[0] == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *stompFrame) set(name, value string) *stompFrame {
+	f.headers = append(f.headers, [2]string{name, value})
+	return f
+}
+
+var stompEscaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+var stompUnescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":")
+
+// The headers of the CONNECT and CONNECTED frames are not escaped.
+func (f *stompFrame) encode() string {
+	escape := f.command != "CONNECTED"
+
+	var b bytes.Buffer
+	b.WriteString(f.command)
+	b.WriteByte('\n')
+	for _, h := range f.headers {
+		if escape {
+			b.WriteString(stompEscaper.Replace(h[0]) + ":" + stompEscaper.Replace(h[1]))
+		} else {
+			b.WriteString(h[0] + ":" + h[1])
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(f.body)
+	b.WriteByte(0)
+
+	return b.String()
+}
+
+// Returns the size limit of the frames of the clients.
+func stompFrameLimit(config Config) int {
+	if config.UpstreamMaxMessageSize > 0 && config.UpstreamMaxMessageSize < stompMaxFrameSize-stompMaxHeaderSize {
+		return int(config.UpstreamMaxMessageSize) + stompMaxHeaderSize
+	}
+
+	return stompMaxFrameSize
+}
+
+// Reads up to and including the delimiter. The frame is malformed if it is longer than the remaining size of the
+// frame, so the client can't make the reader buffer an endless line.
+func readSTOMPUntil(r *bufio.Reader, delim byte, remaining *int) (string, error) {
+	var b []byte
+	for {
+		chunk, err := r.ReadSlice(delim)
+		*remaining -= len(chunk)
+		if *remaining < 0 {
+			return "", errSTOMPMalformed
+		}
+		b = append(b, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return string(b), nil
+	}
+}
+
+func readSTOMPLine(r *bufio.Reader, remaining *int) (string, error) {
+	line, err := readSTOMPUntil(r, '\n', remaining)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// Reads a frame of at most limit bytes from the stream of the websocket frames. The heartbeats (empty lines) between
+// the frames are skipped, and they don't count in the size.
+func readSTOMPFrame(r *bufio.Reader, limit int) (*stompFrame, error) {
+	var command string
+	remaining := limit
+	for command == "" {
+		var err error
+		remaining = limit
+		if command, err = readSTOMPLine(r, &remaining); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &stompFrame{command: command}
+	escaped := command != "CONNECT" && command != "STOMP"
+	for {
+		line, err := readSTOMPLine(r, &remaining)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, errSTOMPMalformed
+		}
+
+		name, value := line[:colon], line[colon+1:]
+		if escaped {
+			name, value = stompUnescaper.Replace(name), stompUnescaper.Replace(value)
+		}
+		f.headers = append(f.headers, [2]string{name, value})
+	}
+
+	if length := f.header("content-length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n >= remaining {
+			return nil, errSTOMPMalformed
+		}
+		body := make([]byte, n+1)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		if body[n] != 0 {
+			return nil, errSTOMPMalformed
+		}
+		f.body = string(body[:n])
+	} else {
+		body, err := readSTOMPUntil(r, 0, &remaining)
+		if err != nil {
+			return nil, err
+		}
+		f.body = body[:len(body)-1]
+	}
+
+	return f, nil
+}
+
+func stompError(message string, code int) *stompFrame {
+	f := &stompFrame{command: "ERROR", closeCode: code, close: true}
+	return f.set("message", message)
+}
+
+// Returns the heartbeat intervals of the client from the heart-beat header.
+func parseSTOMPHeartbeat(header string) (time.Duration, time.Duration) {
+	parts := strings.Split(header, ",")
+	if len(parts) != 2 {
+		return 0, 0
+	}
+
+	cx, _ := strconv.Atoi(strings.TrimSpace(parts[0]))
+	cy, _ := strconv.Atoi(strings.TrimSpace(parts[1]))
+
+	return time.Duration(cx) * time.Millisecond, time.Duration(cy) * time.Millisecond
+}
+
+func stompContentType(h *wshub, patch bool) string {
+	switch {
+	case h.document == "":
+		return "text/plain;charset=utf-8"
+	case patch && h.document == documentMerge:
+		return "application/merge-patch+json"
+	case patch && h.document == documentJSONPatch:
+		return "application/json-patch+json"
+	}
+
+	return "application/json"
+}
+
+func (svc *GoPushService) stompHandler(conn *websocket.Conn, options listenOptions) {
+	r := bufio.NewReader(conn)
+	limit := stompFrameLimit(svc.config)
+
+	send := func(f *stompFrame) error {
+		return websocket.Message.Send(conn, f.encode())
+	}
+
+	f, err := readSTOMPFrame(r, limit)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if f.command != "CONNECT" && f.command != "STOMP" {
+		send(stompError("CONNECT expected", 0))
+		conn.Close()
+		return
+	}
+
+	versions := strings.Split(f.header("accept-version"), ",")
+	supported := false
+	for _, v := range versions {
+		supported = supported || strings.TrimSpace(v) == "1.2"
+	}
+	if !supported {
+		send(stompError("Supported protocol versions are 1.2", 0).set("version", "1.2"))
+		conn.Close()
+		return
+	}
+
+	// The server asks for heartbeats at the ping interval, which is shorter than the read timeout. The text heartbeats
+	// get no answer, so the server sends them only if the heartbeats of the client keep the connection alive.
+	// Otherwise it sends ping frames, which the client answers.
+	m := newMuxConnection(conn, options, svc.config, svc.goingAway)
+	pingInterval := time.Duration(svc.config.PingInterval) * time.Second
+	readTimeout := time.Duration(svc.config.ReadTimeout) * time.Second
+	cx, cy := parseSTOMPHeartbeat(f.header("heart-beat"))
+	var incoming, outgoing time.Duration
+	m.heartbeat = ""
+	if cx > 0 && pingInterval > 0 {
+		incoming = pingInterval
+		if cx > incoming {
+			incoming = cx
+		}
+	}
+	if cy > 0 && pingInterval > 0 && (readTimeout <= 0 || incoming > 0 && incoming < readTimeout) {
+		outgoing = pingInterval
+		if cy > outgoing {
+			outgoing = cy
+		}
+		pingInterval = outgoing
+		m.heartbeat = "\n"
+	}
+
+	connected := &stompFrame{command: "CONNECTED"}
+	connected.set("version", "1.2").set("server", "gopush")
+	connected.set("heart-beat", strconv.FormatInt(int64(outgoing/time.Millisecond), 10)+","+strconv.FormatInt(int64(incoming/time.Millisecond), 10))
+	if err := send(connected); err != nil {
+		conn.Close()
+		return
+	}
+
+	go m.stompReader(svc, r)
+	m.run(pingInterval, func(out muxOutgoing) bool {
+		if out.sub == nil {
+			f := out.frame.(*stompFrame)
+			err := send(f)
+			if f.close {
+				if f.closeCode != 0 {
+					writeClose(conn, f.closeCode)
+				}
+				return false
+			}
+			return err == nil
+		}
+
+		// STOMP can end a subscription only with an error, which closes the connection.
+		if out.message == nil {
+			if out.sub.closeCode == 0 {
+				return true
+			}
+			err := stompError(closeReasons[out.sub.closeCode], out.sub.closeCode).set("subscription", out.key)
+			send(err)
+			writeClose(conn, out.sub.closeCode)
+			return false
+		}
+
+		id := out.message.id()
+		if id == "" {
+			id = genRandomHash(32)
+		}
+
+		patch := out.sub.patches && out.message.patch != ""
+		message := &stompFrame{command: "MESSAGE", body: m.payload(out.sub, out.message)}
+		message.set("subscription", out.key)
+		message.set("message-id", id)
+		message.set("destination", stompDestinationPrefix+out.sub.hub.name)
+		message.set("content-type", stompContentType(out.sub.hub, patch))
+		message.set("content-length", strconv.Itoa(len(message.body)))
+		if out.sub.ack {
+			message.set("ack", id)
+		}
+
+		// The client might acknowledge the message before the send returns.
+		acked := out.sub.ack && out.message.report != nil
+		if acked {
+			m.acks.add(out.message.report)
+		}
+		if send(message) != nil {
+			if acked {
+				m.acks.remove(out.message.report.id)
+			}
+			return false
+		}
+
+		return true
+	})
+}
+
+func (m *muxConnection) stompReader(svc *GoPushService, r *bufio.Reader) {
+	defer m.close(0)
+
+	receipt := func(f *stompFrame) *stompFrame {
+		if id := f.header("receipt"); id != "" {
+			return (&stompFrame{command: "RECEIPT"}).set("receipt-id", id)
+		}
+		return nil
+	}
+
+	// The writer closes the connection after the frame, the reader has to wait for it.
+	fail := func(f *stompFrame) {
+		if id := f.header("receipt"); id != "" {
+			f.set("receipt-id", id)
+		}
+		m.reply(f)
+		<-m.done
+	}
+
+	limit := stompFrameLimit(svc.config)
+	for {
+		f, err := readSTOMPFrame(r, limit)
+		if err != nil {
+			if err == errSTOMPMalformed {
+				fail(stompError(err.Error(), 0))
+			}
+			return
+		}
+
+		switch f.command {
+		case "SUBSCRIBE":
+			id := f.header("id")
+			destination := f.header("destination")
+			if id == "" || !strings.HasPrefix(destination, stompDestinationPrefix) {
+				fail(stompError("SUBSCRIBE needs an id and a "+stompDestinationPrefix+" destination", 0))
+				return
+			}
+
+			center := strings.TrimPrefix(destination, stompDestinationPrefix)
+			hub, ok := svc.getHub(center)
+			if !ok {
+				fail(stompError(closeReasons[closeUnknownCenter], closeUnknownCenter))
+				return
+			}
+			if !hub.allowOrigin(connectionOrigin(m.conn)) {
+				fail(stompError(closeReasons[closeUnauthorized], closeUnauthorized))
+				return
+			}
+
+			options := subscriptionOptions{
+				State:   m.options.State == "1" || m.options.State == "" && hub.sendState,
+				Patches: m.options.Patches,
+				Ack:     f.header("ack") == "client" || f.header("ack") == "client-individual",
+			}
+			if f.hasHeader("state") {
+				options.State = f.header("state") == "true"
+			}
+			if f.hasHeader("patches") {
+				options.Patches = f.header("patches") == "true"
+			}
+
+			var confirmation interface{}
+			if rf := receipt(f); rf != nil {
+				confirmation = rf
+			}
+			if err := m.subscribe(id, hub, options, confirmation); err != nil {
+				fail(stompError(err.Error(), 0))
+				return
+			}
+		case "UNSUBSCRIBE":
+			m.unsubscribe(f.header("id"))
+			if rf := receipt(f); rf != nil {
+				m.reply(rf)
+			}
+		case "ACK", "NACK":
+			if f.command == "ACK" {
+				m.acks.ack(f.header("id"))
+			}
+			if rf := receipt(f); rf != nil {
+				m.reply(rf)
+			}
+		case "SEND":
+			// Messages are forwarded to the upstream of a subscribed center.
+			center := strings.TrimPrefix(f.header("destination"), stompDestinationPrefix)
+			if sub := m.subscriptionOf(center); sub != nil {
+				sub.hub.touch()
+				if sub.hub.upstream != nil && !sub.hub.upstream.deliver(sub, f.body) && m.verbose {
+					log.Println("Message of a client is dropped.")
+				}
+			}
+			if rf := receipt(f); rf != nil {
+				m.reply(rf)
+			}
+		case "DISCONNECT":
+			if rf := receipt(f); rf != nil {
+				rf.close = true
+				fail(rf)
+			}
+			return
+		default:
+			fail(stompError("Unsupported command: "+f.command, 0))
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package gopush
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"log"
+)
+
+var errInvalidTTL = errors.New("Invalid ttl parameter.")
+
+// Returns the TTL from the ttl (seconds) parameter. Zero means that the message does not expire.
+func parseTTL(v url.Values) (time.Duration, error) {
+	ttl := v.Get("ttl")
+	if ttl == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, errInvalidTTL
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// A new message always replaces the expiry of the previous one. The caller must hold the state lock of the center.
+func (svc *GoPushService) setStateExpiry(c *notificationCenter, centername string, m *hubMessage, ttl time.Duration) {
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+
+	c.last = m
+
+	if ttl > 0 {
+		m.expires = time.Now().Add(ttl)
+		c.expiry = time.AfterFunc(ttl, func() {
+			svc.expireState(centername, m)
+		})
+	}
+}
+
+// Reverts the state to the default of the center. The expired message is not delivered anymore to the clients
+// which did not get it yet.
+func (svc *GoPushService) expireState(centername string, m *hubMessage) {
+	c, ok := svc.getCenter(centername)
+	if !ok {
+		return
+	}
+	hub, ok := svc.getHub(centername)
+	if !ok {
+		return
+	}
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.last != m {
+		return
+	}
+
+	tombstone := &hubMessage{data: c.options.DefaultState, remote: m.remote}
+	if c.options.Document != "" {
+		state, _ := svc.getState(centername)
+		patch, err := replacementPatch(c.options.Document, state, c.options.DefaultState)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		tombstone.patch = patch
+	}
+
+	c.expiry = nil
+	svc.setState(centername, c.options.DefaultState)
+	svc.saveState(centername, nil)
+
+	// Without a tombstone the hub still has to know about the new state.
+	tombstone.silent = !c.options.Tombstone
+	hub.post(tombstone)
+}
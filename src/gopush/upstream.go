@@ -0,0 +1,230 @@
+package gopush
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"log"
+)
+
+const upstreamQueueSize = 1024
+
+var errInvalidUpstream = errors.New("Invalid upstream. Supported schemes: http, https, unix.")
+
+type upstreamConnection struct {
+	ID         string `json:"id,omitempty"`
+	RemoteAddr string `json:"remoteaddr"`
+	Origin     string `json:"origin,omitempty"`
+	UserAgent  string `json:"useragent,omitempty"`
+}
+
+type upstreamMessage struct {
+	Center     string             `json:"center"`
+	Message    string             `json:"message"`
+	Time       int64              `json:"time"`
+	Connection upstreamConnection `json:"connection"`
+}
+
+// Delivers the messages sent by the websocket clients to the upstream of the notification center.
+type upstream struct {
+	center   string
+	url      *url.URL
+	secret   string
+	maxSize  int64
+	rate     int64
+	messages chan *upstreamMessage
+	// Canceled when the hub closes, it aborts the request in progress too.
+	ctx    context.Context
+	cancel context.CancelFunc
+	client *http.Client
+	socket net.Conn
+}
+
+func newUpstream(center, destination, secret string, config Config) (*upstream, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "unix":
+		if !config.UpstreamUnixSocket {
+			return nil, errInvalidUpstream
+		}
+	default:
+		return nil, errInvalidUpstream
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &upstream{
+		center:   center,
+		url:      u,
+		secret:   secret,
+		maxSize:  config.UpstreamMaxMessageSize,
+		rate:     config.UpstreamRateLimit,
+		messages: make(chan *upstreamMessage, upstreamQueueSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		client:   newDestinationClient(config),
+	}, nil
+}
+
+// Does not wait for the message in progress, the queued messages are dropped.
+func (u *upstream) stop() {
+	u.cancel()
+}
+
+func (u *upstream) run() {
+	defer func() {
+		if u.socket != nil {
+			u.socket.Close()
+		}
+	}()
+
+	for {
+		select {
+		case m := <-u.messages:
+			if err := u.send(m); err != nil && u.ctx.Err() == nil {
+				log.Printf("Failed to deliver a message to the upstream of %s: %s\n", u.center, err.Error())
+			}
+		case <-u.ctx.Done():
+			return
+		}
+	}
+}
+
+// Queues a message of a client for the upstream. Returns false if the message is dropped.
+func (u *upstream) deliver(c *wsconnection, message string) bool {
+	if u.maxSize > 0 && int64(len(message)) > u.maxSize {
+		return false
+	}
+
+	if c.limiter != nil && !c.limiter.allow() {
+		return false
+	}
+
+	r := c.conn.Request()
+	m := &upstreamMessage{
+		Center:  u.center,
+		Message: message,
+		Time:    time.Now().Unix(),
+		Connection: upstreamConnection{
+			ID:         c.id,
+			RemoteAddr: r.RemoteAddr,
+			Origin:     r.Header.Get("Origin"),
+			UserAgent:  r.Header.Get("User-Agent"),
+		},
+	}
+
+	select {
+	case u.messages <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *upstream) send(m *upstreamMessage) error {
+	marshaled, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if u.url.Scheme == "unix" {
+		return u.sendSocket(marshaled)
+	}
+
+	return u.sendHTTP(marshaled)
+}
+
+func (u *upstream) sendHTTP(body []byte) error {
+	req, err := http.NewRequestWithContext(u.ctx, "POST", u.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if u.secret != "" {
+		req.Header.Set("X-GoPush-Signature", signHMAC(u.secret, body))
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upstream returned status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Messages are written to the socket as newline delimited JSON. A broken connection is reopened with the next message.
+func (u *upstream) sendSocket(body []byte) error {
+	if u.socket == nil {
+		socket, err := net.DialTimeout("unix", u.url.Path, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		u.socket = socket
+	}
+
+	u.socket.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := u.socket.Write(append(body, '\n')); err != nil {
+		u.socket.Close()
+		u.socket = nil
+		return err
+	}
+
+	return nil
+}
+
+func signHMAC(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Simple token bucket. It is not safe for concurrent use.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (l *rateLimiter) allow() bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
@@ -0,0 +1,447 @@
+package gopush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"log"
+)
+
+const defaultWebhookMaxAttempts = 5
+
+const webhookMaxRetryDelay = 10 * time.Minute
+
+// Number of the undeliverable messages kept per webhook.
+const webhookDeadLetterLimit = 100
+
+var errInvalidWebhook = errors.New("Invalid webhook URL. Supported schemes: http, https.")
+
+// A webhook as it is saved with the options of the center.
+type webhookOptions struct {
+	ID     string
+	URL    string
+	Secret string
+}
+
+// The body of the requests of a webhook.
+type webhookMessage struct {
+	Center  string `json:"center"`
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	Patch   string `json:"patch,omitempty"`
+	Time    int64  `json:"time"`
+}
+
+type webhookDelivery struct {
+	id       string
+	message  *hubMessage
+	body     []byte
+	attempts int
+}
+
+type webhookDeadLetter struct {
+	ID       string `json:"id"`
+	Message  string `json:"message"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+	Time     int64  `json:"time"`
+}
+
+type webhookStatus struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Failed counts every failed attempt, also the ones which are retried.
+	Delivered    int64 `json:"delivered"`
+	Failed       int64 `json:"failed"`
+	DeadLettered int64 `json:"deadlettered"`
+	Retrying     int64 `json:"retrying"`
+	// Unix timestamps
+	LastAttempt int64               `json:"lastattempt,omitempty"`
+	LastSuccess int64               `json:"lastsuccess,omitempty"`
+	LastStatus  int                 `json:"laststatus,omitempty"`
+	LastError   string              `json:"lasterror,omitempty"`
+	DeadLetters []webhookDeadLetter `json:"deadletters,omitempty"`
+}
+
+// POSTs the notifications of a center to an HTTP endpoint. It is a subscriber of the hub like the websocket
+// connections, and it retries the failed deliveries with exponential backoff.
+type webhook struct {
+	options     webhookOptions
+	center      string
+	subscriber  *hubSubscriber
+	client      *http.Client
+	maxAttempts int
+	retryDelay  time.Duration
+	verbose     bool
+	retries     chan *webhookDelivery
+	done        chan bool
+	// Guards the status.
+	lock        sync.Mutex
+	status      webhookStatus
+	deadLetters []webhookDeadLetter
+}
+
+func newWebhook(options webhookOptions, center string, hub *wshub, config Config) *webhook {
+	w := &webhook{
+		options:     options,
+		center:      center,
+		subscriber:  newHubSubscriber(hub, "webhook:"+options.ID, config.ExtraLogging),
+		client:      newDestinationClient(config),
+		maxAttempts: defaultWebhookMaxAttempts,
+		retryDelay:  time.Second,
+		verbose:     config.ExtraLogging,
+		retries:     make(chan *webhookDelivery),
+		done:        make(chan bool),
+		status:      webhookStatus{ID: options.ID, URL: options.URL},
+	}
+	if config.WebhookMaxAttempts > 0 {
+		w.maxAttempts = int(config.WebhookMaxAttempts)
+	}
+	if config.WebhookRetryDelay > 0 {
+		w.retryDelay = time.Duration(config.WebhookRetryDelay) * time.Second
+	}
+
+	return w
+}
+
+func validateWebhookURL(destination string, config Config) error {
+	u, err := url.Parse(destination)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errInvalidWebhook
+	}
+
+	return checkDestination(destination, config)
+}
+
+// Removes the webhook from the hub. The pending retries are dropped.
+func (w *webhook) stop() {
+	w.subscriber.stop()
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+
+	if !w.subscriber.subscribe() {
+		return
+	}
+
+	for {
+		select {
+		case m, ok := <-w.subscriber.messages():
+			if !ok {
+				if w.subscriber.resubscribe() {
+					continue
+				}
+				return
+			}
+			// The node which received the notification calls the webhook.
+			if m.remote {
+				continue
+			}
+			if m.expired() {
+				w.subscriber.sub.countDropped(m)
+				continue
+			}
+			w.attempt(w.newDelivery(m))
+		case d := <-w.retries:
+			w.lock.Lock()
+			w.status.Retrying--
+			w.lock.Unlock()
+			w.attempt(d)
+		}
+	}
+}
+
+func (w *webhook) newDelivery(m *hubMessage) *webhookDelivery {
+	d := &webhookDelivery{id: m.id(), message: m}
+	if d.id == "" {
+		d.id = genRandomHash(32)
+	}
+
+	marshaled, err := json.Marshal(webhookMessage{
+		Center:  w.center,
+		ID:      d.id,
+		Message: m.data,
+		Patch:   m.patch,
+		Time:    time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+	d.body = marshaled
+
+	return d
+}
+
+// Sends a message, and schedules a retry or moves the message to the dead letters if it fails.
+func (w *webhook) attempt(d *webhookDelivery) {
+	d.attempts++
+	code, err := w.post(d)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := time.Now().Unix()
+	w.status.LastAttempt = now
+	w.status.LastStatus = code
+	if err == nil {
+		w.status.Delivered++
+		w.status.LastSuccess = now
+		w.status.LastError = ""
+		return
+	}
+
+	w.status.Failed++
+	w.status.LastError = err.Error()
+	if w.verbose {
+		log.Printf("Webhook %s of %s failed (attempt %d): %s\n", w.options.ID, w.center, d.attempts, err.Error())
+	}
+
+	if d.attempts >= w.maxAttempts {
+		w.status.DeadLettered++
+		w.deadLetters = append(w.deadLetters, webhookDeadLetter{
+			ID:       d.id,
+			Message:  d.message.data,
+			Attempts: d.attempts,
+			Error:    err.Error(),
+			Time:     now,
+		})
+		if len(w.deadLetters) > webhookDeadLetterLimit {
+			w.deadLetters = w.deadLetters[len(w.deadLetters)-webhookDeadLetterLimit:]
+		}
+		return
+	}
+
+	w.status.Retrying++
+	delay := w.retryDelay << uint(d.attempts-1)
+	if delay > webhookMaxRetryDelay || delay <= 0 {
+		delay = webhookMaxRetryDelay
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case w.retries <- d:
+		case <-w.done:
+		}
+	})
+}
+
+// Returns the status code of the response, or 0 if there is none.
+func (w *webhook) post(d *webhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", w.options.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-GoPush-Signature", signHMAC(w.options.Secret, d.body))
+	req.Header.Set("X-GoPush-Webhook", w.options.ID)
+	req.Header.Set("X-GoPush-Attempt", strconv.Itoa(d.attempts))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook returned status code %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func (w *webhook) getStatus(deadLetters bool) webhookStatus {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	status := w.status
+	if deadLetters {
+		status.DeadLetters = append([]webhookDeadLetter(nil), w.deadLetters...)
+	}
+
+	return status
+}
+
+// Starts the webhooks and the Web Push sender saved with the options of a center. Must be called after the hub is
+// started.
+func (svc *GoPushService) startWebhooks(c *notificationCenter, centername string) {
+	c.webhookLock.Lock()
+	defer c.webhookLock.Unlock()
+
+	c.webhooks = make(map[string]*webhook)
+	for _, options := range c.options.Webhooks {
+		svc.startWebhook(c, centername, options)
+	}
+	svc.startWebPush(c, centername)
+}
+
+// The caller must hold the webhook lock of the center.
+func (svc *GoPushService) startWebhook(c *notificationCenter, centername string, options webhookOptions) {
+	// The center might be removed in the meantime.
+	hub, ok := svc.getHub(centername)
+	if !ok {
+		return
+	}
+
+	w := newWebhook(options, centername, hub, svc.config)
+	c.webhooks[options.ID] = w
+	go w.run()
+}
+
+func (svc *GoPushService) handleAddWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+	centername := svc.lookupCenter(mail, string(body))
+	c, ok := svc.getCenter(centername)
+	if !ok {
+		serve404(w)
+		return
+	}
+
+	if err := validateWebhookURL(v.Get("url"), svc.config); err != nil {
+		serve400(w, err)
+		return
+	}
+
+	options := webhookOptions{
+		ID:     genRandomHash(16),
+		URL:    v.Get("url"),
+		Secret: v.Get("secret"),
+	}
+	if options.Secret == "" {
+		options.Secret = genRandomHash(32)
+	}
+
+	c.webhookLock.Lock()
+	candidate := c.options
+	candidate.Webhooks = append(append([]webhookOptions(nil), c.options.Webhooks...), options)
+	if err := checkStoredOptions(candidate); err != nil {
+		c.webhookLock.Unlock()
+		serve400(w, err)
+		return
+	}
+	c.options.Webhooks = candidate.Webhooks
+	svc.startWebhook(c, centername, options)
+	svc.saveCenter(c, centername)
+	svc.publishOptions(c, centername)
+	c.webhookLock.Unlock()
+
+	marshaled, err := json.Marshal(map[string]string{"id": options.ID, "secret": options.Secret})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(marshaled)
+}
+
+func (svc *GoPushService) handleRemoveWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+	id := v.Get("id")
+	centername := svc.lookupCenter(mail, string(body))
+	c, ok := svc.getCenter(centername)
+	if !ok {
+		serve404(w)
+		return
+	}
+
+	c.webhookLock.Lock()
+	hook, ok := c.webhooks[id]
+	if !ok {
+		c.webhookLock.Unlock()
+		serve404(w)
+		return
+	}
+
+	delete(c.webhooks, id)
+	webhooks := make([]webhookOptions, 0, len(c.options.Webhooks))
+	for _, options := range c.options.Webhooks {
+		if options.ID != id {
+			webhooks = append(webhooks, options)
+		}
+	}
+	c.options.Webhooks = webhooks
+	svc.saveCenter(c, centername)
+	svc.publishOptions(c, centername)
+	c.webhookLock.Unlock()
+
+	hook.stop()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (svc *GoPushService) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !svc.checkAuth(r, body) {
+		serve401(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	mail := v.Get("mail")
+	centername := svc.lookupCenter(mail, string(body))
+	c, ok := svc.getCenter(centername)
+	if !ok {
+		serve404(w)
+		return
+	}
+
+	deadLetters := v.Get("deadletters") != ""
+
+	c.webhookLock.Lock()
+	list := make([]webhookStatus, 0, len(c.options.Webhooks))
+	for _, options := range c.options.Webhooks {
+		if hook, ok := c.webhooks[options.ID]; ok {
+			list = append(list, hook.getStatus(deadLetters))
+		}
+	}
+	c.webhookLock.Unlock()
+
+	marshaled, err := json.Marshal(list)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaled)
+}
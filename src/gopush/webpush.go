@@ -0,0 +1,614 @@
+package gopush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"log"
+)
+
+// Web Push (RFC 8030) with VAPID (RFC 8292) and aes128gcm payload encryption (RFC 8291).
+
+// TTL of the pushed messages which do not expire.
+const webPushDefaultTTL = 24 * time.Hour
+
+// Record size of the encrypted payload. Push services accept at least 4096 bytes.
+const webPushRecordSize = 4096
+
+// Header of the encrypted payload: salt, record size, key length and the public key of the server.
+const webPushHeaderSize = 16 + 4 + 1 + 65
+
+// A message has to fit in one record with the padding delimiter and the authentication tag.
+const webPushMaxMessageSize = webPushRecordSize - webPushHeaderSize - 1 - 16
+
+const webPushMaxSubscriptions = 1000
+
+// Subscriptions per second per center. Anyone can send them, the origin is not a proof.
+const webPushSubscribeRate = 10
+
+// Number of requests sent to the push services at the same time per center.
+const webPushConcurrency = 16
+
+var (
+	errInvalidVAPIDKey          = errors.New("Invalid VAPID private key.")
+	errInvalidPushSubscription  = errors.New("Invalid push subscription.")
+	errTooManyPushSubscriptions = errors.New("Too many push subscriptions.")
+	errPushSubscribeRateLimited = errors.New("Too many push subscriptions in a short time.")
+	errPushOriginNotAllowed     = errors.New("Push subscriptions are not allowed from this origin.")
+	errPushSubscriptionGone     = errors.New("push subscription is gone")
+	errPushMessageTooLarge      = errors.New("message is too large for Web Push")
+)
+
+// A PushSubscription of the browser, as it is serialized by toJSON().
+type webPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	// Milliseconds since the epoch, nil if the subscription does not expire.
+	ExpirationTime *int64 `json:"expirationTime"`
+	Keys           struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+func (s *webPushSubscription) expired(now time.Time) bool {
+	return s.ExpirationTime != nil && *s.ExpirationTime > 0 && *s.ExpirationTime <= now.UnixNano()/int64(time.Millisecond)
+}
+
+// Browsers send unpadded base64url, but some libraries pad it.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (s *webPushSubscription) validate(insecure bool) error {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(insecure && u.Scheme == "http")) {
+		return errInvalidPushSubscription
+	}
+
+	key, err := decodeBase64URL(s.Keys.P256dh)
+	if err != nil {
+		return errInvalidPushSubscription
+	}
+	if _, err := ecdh.P256().NewPublicKey(key); err != nil {
+		return errInvalidPushSubscription
+	}
+
+	auth, err := decodeBase64URL(s.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return errInvalidPushSubscription
+	}
+
+	return nil
+}
+
+// The application server key pair of the service.
+type vapidKeys struct {
+	private *ecdsa.PrivateKey
+	// Uncompressed point, base64url encoded. This is the applicationServerKey of the browsers.
+	public string
+}
+
+// Loads the VAPID key of the configuration. Without a configured key, a temporary key is generated, and the
+// subscriptions of the browsers don't survive a restart.
+func loadVAPIDKeys(config Config) (*vapidKeys, error) {
+	var key *ecdh.PrivateKey
+	var err error
+	if config.VAPIDPrivateKey == "" {
+		log.Println("No VAPID private key is configured, the Web Push subscriptions won't work after a restart.")
+		key, err = ecdh.P256().GenerateKey(rand.Reader)
+	} else {
+		var raw []byte
+		if raw, err = decodeBase64URL(config.VAPIDPrivateKey); err == nil {
+			key, err = ecdh.P256().NewPrivateKey(raw)
+		}
+	}
+	if err != nil {
+		return nil, errInvalidVAPIDKey
+	}
+
+	public := key.PublicKey().Bytes()
+	private := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(key.Bytes()),
+	}
+
+	return &vapidKeys{private: private, public: base64.RawURLEncoding.EncodeToString(public)}, nil
+}
+
+// Returns the value of the Authorization header for a push service: an ES256 JWT for the origin of the endpoint.
+func (k *vapidKeys) authorization(endpoint, subject string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims := map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+	}
+	if subject != "" {
+		claims["sub"] = subject
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return "vapid t=" + unsigned + "." + base64.RawURLEncoding.EncodeToString(signature) + ", k=" + k.public, nil
+}
+
+// HKDF-SHA-256 with one block of output.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{1})
+
+	return expand.Sum(nil)[:length]
+}
+
+// Encrypts a message for a subscription with the aes128gcm content coding, in a single record (RFC 8291, RFC 8188).
+func encryptWebPush(s *webPushSubscription, message []byte) ([]byte, error) {
+	if len(message) > webPushMaxMessageSize {
+		return nil, errPushMessageTooLarge
+	}
+
+	rawKey, err := decodeBase64URL(s.Keys.P256dh)
+	if err != nil {
+		return nil, errInvalidPushSubscription
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(rawKey)
+	if err != nil {
+		return nil, errInvalidPushSubscription
+	}
+	auth, err := decodeBase64URL(s.Keys.Auth)
+	if err != nil {
+		return nil, errInvalidPushSubscription
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	keyInfo := append([]byte("WebPush: info\x00"), rawKey...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(auth, secret, keyInfo, 32)
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, webPushHeaderSize)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// The last record is delimited with 0x02.
+	plaintext := append(append([]byte(nil), message...), 2)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// Pushes the notifications of a center to the push services of its subscriptions. It is one subscriber of the hub
+// for all the subscriptions of the center.
+type webPushSender struct {
+	subscriber *hubSubscriber
+	keys       *vapidKeys
+	subject    string
+	client     *http.Client
+	verbose    bool
+	// Called when a push service tells that a subscription is gone.
+	gone func(endpoint string)
+	// Guards the subscriptions.
+	lock          sync.Mutex
+	subscriptions map[string]*webPushSubscription
+}
+
+func newWebPushSender(hub *wshub, keys *vapidKeys, config Config, gone func(endpoint string)) *webPushSender {
+	return &webPushSender{
+		subscriber:    newHubSubscriber(hub, "webpush", config.ExtraLogging),
+		keys:          keys,
+		subject:       config.VAPIDSubject,
+		client:        newDestinationClient(config),
+		verbose:       config.ExtraLogging,
+		gone:          gone,
+		subscriptions: make(map[string]*webPushSubscription),
+	}
+}
+
+func (w *webPushSender) set(s webPushSubscription) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.subscriptions[s.Endpoint] = &s
+}
+
+func (w *webPushSender) remove(endpoint string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	delete(w.subscriptions, endpoint)
+}
+
+// Replaces the subscriptions, when they were changed on another node of the cluster.
+func (w *webPushSender) reset(subscriptions []webPushSubscription) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.subscriptions = make(map[string]*webPushSubscription)
+	for i := range subscriptions {
+		s := subscriptions[i]
+		w.subscriptions[s.Endpoint] = &s
+	}
+}
+
+func (w *webPushSender) run() {
+	if !w.subscriber.subscribe() {
+		return
+	}
+
+	for {
+		m, ok := <-w.subscriber.messages()
+		if !ok {
+			if w.subscriber.resubscribe() {
+				continue
+			}
+			return
+		}
+
+		// The node which received the notification sends it to the push services.
+		if m.remote {
+			continue
+		}
+		if m.expired() {
+			w.subscriber.sub.countDropped(m)
+			continue
+		}
+
+		w.push(m)
+	}
+}
+
+// Sends a message to every subscription.
+func (w *webPushSender) push(m *hubMessage) {
+	now := time.Now()
+
+	w.lock.Lock()
+	subscriptions := make([]*webPushSubscription, 0, len(w.subscriptions))
+	for _, s := range w.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	w.lock.Unlock()
+
+	var wg sync.WaitGroup
+	limit := make(chan bool, webPushConcurrency)
+	for _, s := range subscriptions {
+		if s.expired(now) {
+			w.gone(s.Endpoint)
+			continue
+		}
+
+		wg.Add(1)
+		limit <- true
+		go func(s *webPushSubscription) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+
+			err := w.send(s, m)
+			switch {
+			case err == errPushSubscriptionGone:
+				w.gone(s.Endpoint)
+			case err != nil && w.verbose:
+				log.Printf("Failed to push a message of %s: %s\n", w.subscriber.hub.name, err.Error())
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (w *webPushSender) send(s *webPushSubscription, m *hubMessage) error {
+	body, err := encryptWebPush(s, []byte(m.data))
+	if err != nil {
+		return err
+	}
+
+	authorization, err := w.keys.authorization(s.Endpoint, w.subject)
+	if err != nil {
+		return err
+	}
+
+	ttl := webPushDefaultTTL
+	if !m.expires.IsZero() {
+		ttl = m.expires.Sub(time.Now())
+		if ttl < 0 {
+			ttl = 0
+		}
+	}
+
+	req, err := http.NewRequest("POST", s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.FormatInt(int64(ttl/time.Second), 10))
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushSubscriptionGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("push service returned status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Starts the sender of a center if it has subscriptions. The caller must hold the webhook lock of the center, and
+// the hub must be started.
+func (svc *GoPushService) startWebPush(c *notificationCenter, centername string) {
+	if c.webPush != nil || len(c.options.WebPush) == 0 {
+		return
+	}
+
+	// The center might be removed in the meantime.
+	hub, ok := svc.getHub(centername)
+	if !ok {
+		return
+	}
+
+	c.webPush = newWebPushSender(hub, svc.vapid, svc.config, func(endpoint string) {
+		svc.removeWebPushSubscription(c, centername, endpoint)
+	})
+	for _, s := range c.options.WebPush {
+		c.webPush.set(s)
+	}
+	go c.webPush.run()
+}
+
+func (svc *GoPushService) addWebPushSubscription(c *notificationCenter, centername string, s webPushSubscription) error {
+	c.webhookLock.Lock()
+	defer c.webhookLock.Unlock()
+
+	if c.pushLimiter == nil {
+		c.pushLimiter = newRateLimiter(webPushSubscribeRate)
+	}
+	if !c.pushLimiter.allow() {
+		return errPushSubscribeRateLimited
+	}
+
+	replaced := false
+	for i := range c.options.WebPush {
+		if c.options.WebPush[i].Endpoint == s.Endpoint {
+			c.options.WebPush[i] = s
+			replaced = true
+		}
+	}
+	if !replaced {
+		if len(c.options.WebPush) >= webPushMaxSubscriptions {
+			return errTooManyPushSubscriptions
+		}
+		c.options.WebPush = append(c.options.WebPush, s)
+	}
+
+	if c.webPush == nil {
+		svc.startWebPush(c, centername)
+	} else {
+		c.webPush.set(s)
+	}
+	svc.savePushSubscription(centername, s)
+	svc.publishOptions(c, centername)
+
+	return nil
+}
+
+// Returns false if the center has no such subscription.
+func (svc *GoPushService) removeWebPushSubscription(c *notificationCenter, centername, endpoint string) bool {
+	c.webhookLock.Lock()
+	defer c.webhookLock.Unlock()
+
+	subscriptions := make([]webPushSubscription, 0, len(c.options.WebPush))
+	for _, s := range c.options.WebPush {
+		if s.Endpoint != endpoint {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	if len(subscriptions) == len(c.options.WebPush) {
+		return false
+	}
+
+	c.options.WebPush = subscriptions
+	if c.webPush != nil {
+		c.webPush.remove(endpoint)
+	}
+
+	// The center might be removed in the meantime.
+	if current, _ := svc.getCenter(centername); current == c {
+		if err := svc.backend.RemovePushSubscription(centername, endpoint); err != nil {
+			log.Println(err.Error())
+		}
+		svc.publishOptions(c, centername)
+	}
+
+	return true
+}
+
+// The subscriptions are registered by the browsers without a signature, so only the pages of the origins allowed
+// by the center can register them.
+func allowPushOrigin(c *notificationCenter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	for _, o := range c.options.WebPushOrigins {
+		if origin != "" && origin == o {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (svc *GoPushService) handleVAPIDKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		serve405(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(svc.vapid.public))
+}
+
+func (svc *GoPushService) handleWebPushSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	centername := v.Get("center")
+	c, ok := svc.getCenter(centername)
+	if !ok {
+		serve404(w)
+		return
+	}
+
+	if !allowPushOrigin(c, r) {
+		serve403(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var s webPushSubscription
+	if err := json.Unmarshal(body, &s); err != nil {
+		serve400(w, errInvalidPushSubscription)
+		return
+	}
+
+	if err := s.validate(svc.config.WebPushInsecureEndpoints); err != nil {
+		serve400(w, err)
+		return
+	}
+
+	if s.expired(time.Now()) {
+		serve400(w, errInvalidPushSubscription)
+		return
+	}
+
+	if err := checkDestination(s.Endpoint, svc.config); err != nil {
+		serve400(w, err)
+		return
+	}
+
+	switch err := svc.addWebPushSubscription(c, centername, s); err {
+	case nil:
+	case errPushSubscribeRateLimited:
+		serve429(w)
+		return
+	default:
+		serve403(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (svc *GoPushService) handleWebPushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		serve405(w)
+		return
+	}
+
+	v, _ := url.ParseQuery(r.URL.RawQuery)
+	centername := v.Get("center")
+	c, ok := svc.getCenter(centername)
+	if !ok {
+		serve404(w)
+		return
+	}
+
+	if !allowPushOrigin(c, r) {
+		serve403(w)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var s webPushSubscription
+	if err := json.Unmarshal(body, &s); err != nil || s.Endpoint == "" {
+		serve400(w, errInvalidPushSubscription)
+		return
+	}
+
+	if !svc.removeWebPushSubscription(c, centername, s.Endpoint) {
+		serve404(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,45 @@
+package gopush
+
+import (
+	"encoding/binary"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// Close codes of the connections closed by the server. The 4000-4999 range is reserved for applications
+// by RFC 6455. Clients should not reconnect after the codes between 4000 and 4002, and 4004. After 4005 they should
+// reconnect to the address in the reason.
+const (
+	closeGoingAway     = 1001
+	closeUnknownCenter = 4000
+	closeCenterRemoved = 4001
+	closeCenterExpired = 4002
+	closeTooSlow       = 4003
+	closeUnauthorized  = 4004
+	closeMoved         = 4005
+)
+
+var closeReasons = map[int]string{
+	closeGoingAway:     "server shutting down",
+	closeUnknownCenter: "unknown notification center",
+	closeCenterRemoved: "notification center removed",
+	closeCenterExpired: "notification center expired",
+	closeTooSlow:       "too slow",
+	closeUnauthorized:  "unauthorized",
+	closeMoved:         "moved",
+}
+
+// Sends a close frame with a status code and a reason. It must not be called concurrently with other writes.
+func writeClose(conn *websocket.Conn, code int) error {
+	return writeCloseReason(conn, code, closeReasons[code])
+}
+
+func writeCloseReason(conn *websocket.Conn, code int, reason string) error {
+	msg := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(msg, uint16(code))
+	copy(msg[2:], reason)
+
+	conn.PayloadType = websocket.CloseFrame
+	_, err := conn.Write(msg)
+	return err
+}
@@ -1,17 +1,54 @@
 package gopush
 
 import (
+	"errors"
 	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
 
 	"code.google.com/p/go.net/websocket"
 )
 
+type listenOptions struct {
+	ID        string
+	Ack       bool
+	Heartbeat bool
+	Patches   bool
+	// "1" or "0" to override the sendstate option of the center.
+	State string
+}
+
+func parseListenOptions(v url.Values) listenOptions {
+	return listenOptions{
+		ID:        v.Get("id"),
+		Ack:       v.Get("ack") != "",
+		Heartbeat: v.Get("heartbeat") != "",
+		Patches:   v.Get("patches") != "",
+		State:     v.Get("state"),
+	}
+}
+
 type wsconnection struct {
 	conn      *websocket.Conn
-	send      chan string
+	send      chan *hubMessage
 	writequit chan bool
 	hub       *wshub
+	id        string
+	ack       bool
+	acks      *pendingAcks // The delivered messages waiting for an acknowledgement, if ack is set.
+	heartbeat bool
+	patches   bool // Patches instead of full documents from a document center.
+	sendState bool // The current state is the first message.
+	limiter   *rateLimiter
 	verbose   bool
+	// Close code sent to the client when the hub closes the send channel. Set by the hub before closing it.
+	closeCode int
+	// The connection of a subscription of a multiplexed connection, nil for the plain connections.
+	mux *muxConnection
+	// A webhook or a push sender. It gets the messages, but it is not a listener of the center.
+	internal bool
 }
 
 func (c *wsconnection) reader() {
@@ -28,10 +65,26 @@ func (c *wsconnection) reader() {
 		if err != nil {
 			return
 		}
+
+		c.hub.touch()
+
+		if c.heartbeat && message == heartbeatMessage {
+			continue
+		}
+
+		if c.ack && c.hub.reports != nil && c.handleAck(message) {
+			continue
+		}
+
+		if c.hub.upstream != nil {
+			if !c.hub.upstream.deliver(c, message) && c.verbose {
+				log.Println("Message of a client is dropped.")
+			}
+		}
 	}
 }
 
-func (c *wsconnection) writer() {
+func (c *wsconnection) writer(pingInterval time.Duration) {
 	defer func() {
 		if c.verbose {
 			log.Println("Closing connection.")
@@ -39,16 +92,62 @@ func (c *wsconnection) writer() {
 		c.conn.Close()
 	}()
 
+	// A nil channel blocks forever, so without an interval there are no pings.
+	var ping <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
 	for {
 		select {
-		case message := <-c.send:
+		case <-ping:
+			var err error
+			if c.heartbeat {
+				err = websocket.Message.Send(c.conn, heartbeatMessage)
+			} else {
+				err = writePing(c.conn)
+			}
+			if err != nil {
+				return
+			}
+		case message, ok := <-c.send:
+			if !ok {
+				if c.closeCode != 0 {
+					writeClose(c.conn, c.closeCode)
+				}
+				return
+			}
+			if message.expired() {
+				c.countDropped(message)
+				continue
+			}
 			if c.verbose {
 				log.Println("Sending message through websocket.")
 			}
-			err := websocket.Message.Send(c.conn, message)
+			data := message.data
+			if c.patches && message.patch != "" {
+				data = message.patch
+			}
+			if c.ack {
+				data = encodeAckEnvelope(message, data)
+			}
+			// The client might acknowledge the message before Send returns.
+			if c.ack && message.report != nil {
+				c.acks.add(message.report)
+			}
+			err := websocket.Message.Send(c.conn, data)
 			if err != nil {
+				if c.ack && message.report != nil {
+					c.acks.remove(message.report.id)
+				}
+				c.countDropped(message)
 				return
 			}
+			if message.report != nil {
+				atomic.AddInt64(&message.report.delivered, 1)
+			}
 		case q := <-c.writequit:
 			if q {
 				return
@@ -57,20 +156,122 @@ func (c *wsconnection) writer() {
 	}
 }
 
+// The internal subscribers are not recipients of the delivery reports.
+func (c *wsconnection) countDropped(m *hubMessage) {
+	if m.report != nil && !c.internal {
+		atomic.AddInt64(&m.report.dropped, 1)
+	}
+}
+
 func (c *wsconnection) quit() {
 	c.writequit <- true
 }
 
-func wsHandler(conn *websocket.Conn, h *wshub, verbose bool) {
+// The Origin header of the handshake, empty if the client sent none.
+func connectionOrigin(conn *websocket.Conn) string {
+	return conn.Request().Header.Get("Origin")
+}
+
+// Websocket subprotocols of /listen, in the order of preference.
+var listenProtocols = []string{muxProtocol, stompProtocol}
+
+// Returns a handshake which picks a supported subprotocol. If the origin is required, it checks the origin like
+// the default handshake of the websocket package.
+func protocolHandshake(protocols []string, requireOrigin bool) func(*websocket.Config, *http.Request) error {
+	return func(config *websocket.Config, r *http.Request) error {
+		var err error
+		if config.Origin, err = websocket.Origin(config, r); err != nil {
+			return err
+		}
+		if requireOrigin && config.Origin == nil {
+			return errors.New("null origin")
+		}
+
+		offered := config.Protocol
+		config.Protocol = nil
+		for _, protocol := range protocols {
+			for _, o := range offered {
+				if o == protocol {
+					config.Protocol = []string{protocol}
+					return nil
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+func (svc *GoPushService) handleListen(conn *websocket.Conn) {
+	v, _ := url.ParseQuery(conn.Request().URL.RawQuery)
+	options := parseListenOptions(v)
+
+	if protocol := conn.Config().Protocol; len(protocol) == 1 && protocol[0] == muxProtocol {
+		svc.muxHandler(conn, options)
+		return
+	}
+
+	if protocol := conn.Config().Protocol; len(protocol) == 1 && protocol[0] == stompProtocol {
+		svc.stompHandler(conn, options)
+		return
+	}
+
+	center := v.Get("center")
+	if hub, ok := svc.getHub(center); ok && !hub.allowOrigin(connectionOrigin(conn)) {
+		if svc.config.ExtraLogging {
+			log.Println("Client connection refused from its origin.")
+		}
+		writeClose(conn, closeUnauthorized)
+		conn.Close()
+	} else if ok {
+		if svc.config.ExtraLogging {
+			log.Println("Client connected.")
+		}
+		wsHandler(conn, hub, options, svc.config)
+	} else {
+		if svc.config.ExtraLogging {
+			log.Println("Client connection rejected.")
+		}
+		// The centers are gone during the shutdown, but the client should come back.
+		if svc.isStopping() {
+			writeClose(conn, closeGoingAway)
+		} else {
+			writeClose(conn, closeUnknownCenter)
+		}
+		conn.Close()
+	}
+}
+
+func wsHandler(conn *websocket.Conn, h *wshub, options listenOptions, config Config) {
 	c := &wsconnection{
-		send:      make(chan string, 256),
+		send:      make(chan *hubMessage, h.sendBuffer),
 		conn:      conn,
 		hub:       h,
-		writequit: make(chan bool),
-		verbose:   verbose,
+		writequit: make(chan bool, 1),
+		id:        options.ID,
+		ack:       options.Ack,
+		acks:      newPendingAcks(),
+		heartbeat: options.Heartbeat,
+		patches:   options.Patches,
+		sendState: options.State == "1" || options.State == "" && h.sendState,
+		verbose:   config.ExtraLogging,
+	}
+	if h.upstream != nil && h.upstream.rate > 0 {
+		c.limiter = newRateLimiter(h.upstream.rate)
 	}
-	c.hub.register <- c
-	defer func() { c.hub.unregister <- c }()
+	// The hub might be closed in the meantime, then the connection is closed as the center is gone.
+	select {
+	case c.hub.register <- c:
+	case <-c.hub.closed:
+		writeClose(conn, c.hub.closeCode)
+		return
+	}
+	defer func() {
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.closed:
+		}
+	}()
 	go c.reader()
-	c.writer()
+	c.writer(time.Duration(config.PingInterval) * time.Second)
 }
@@ -2,24 +2,101 @@ package gopush
 
 import (
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+type hubMessage struct {
+	data    string
+	patch   string    // The patch which produced the data, in a document center.
+	expires time.Time // Zero if the message does not expire.
+	report  *deliveryReport
+	silent  bool // The message only changes the state of the hub, it is not delivered.
+	initial bool // The current state, sent to a new connection.
+	remote  bool // The notification was sent on another node of the cluster.
+}
+
+func (m *hubMessage) id() string {
+	if m.report == nil {
+		return ""
+	}
+
+	return m.report.id
+}
+
+func (m *hubMessage) expired() bool {
+	return !m.expires.IsZero() && time.Now().After(m.expires)
+}
+
 type wshub struct {
+	name        string
 	connections map[*wsconnection]bool
-	broadcast   chan string
+	broadcast   chan *hubMessage
 	register    chan *wsconnection
 	unregister  chan *wsconnection
-	quit        chan bool
+	presence    chan chan hubPresence
+	quit        chan int // The close code sent to the clients.
+	closed      chan bool
+	closeCode   int // Set before closed is closed.
 	verbose     bool
+	// Hub which receives the join and leave events. Nil if the events are disabled.
+	presenceHub *wshub
+	// Destination of the messages sent by the clients. Nil if the messages are discarded.
+	upstream *upstream
+	// Delivery reports of the messages. Nil if the messages are not tracked.
+	reports *deliveryReports
+	// Size of the send buffers of the connections and the policy when they are full.
+	sendBuffer int64
+	policy     string
+	// Called on listener activity. Nil if the activity is not tracked.
+	activity func()
+	// The origins of the pages which may listen. Anybody can, if it is empty.
+	origins []string
+	// The current state, sent to the new connections which ask for it. Only the hub goroutine uses it.
+	state     *hubMessage
+	sendState bool
+	// Patch format of a document center.
+	document string
+	// Number of times the slow consumer policy was triggered.
+	disconnected  int64
+	droppedOldest int64
+	coalesced     int64
 }
 
 func newWSHub(broadcastBuffer int64) *wshub {
 	return &wshub{
 		connections: make(map[*wsconnection]bool),
-		broadcast:   make(chan string, broadcastBuffer),
+		broadcast:   make(chan *hubMessage, broadcastBuffer),
 		register:    make(chan *wsconnection),
 		unregister:  make(chan *wsconnection),
-		quit:        make(chan bool),
+		presence:    make(chan chan hubPresence),
+		quit:        make(chan int),
+		closed:      make(chan bool),
+		sendBuffer:  defaultSendBuffer,
+		policy:      policyDisconnect,
+	}
+}
+
+// Returns false if the origin of a connection may not listen to the hub. The clients without an origin, like the
+// MQTT clients, may listen only to the hubs without a list of origins.
+func (h *wshub) allowOrigin(origin string) bool {
+	if len(h.origins) == 0 {
+		return true
+	}
+
+	for _, o := range h.origins {
+		if origin != "" && origin == o {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *wshub) touch() {
+	if h.activity != nil {
+		h.activity()
 	}
 }
 
@@ -31,32 +108,158 @@ func (h *wshub) run() {
 				log.Println("Registering client")
 			}
 			h.connections[c] = true
+			// The state is queued before any later broadcast, so the client can't miss or reorder a change.
+			if c.sendState && h.state != nil {
+				h.deliver(c, &hubMessage{data: h.state.data, expires: h.state.expires, initial: true})
+			}
+			h.publishPresence("join", c)
+			if !c.internal {
+				h.touch()
+			}
 		case c := <-h.unregister:
 			if h.verbose {
 				log.Println("Unregistering client")
 			}
-			delete(h.connections, c)
-			close(c.send)
+			if _, ok := h.connections[c]; ok {
+				delete(h.connections, c)
+				close(c.send)
+				h.publishPresence("leave", c)
+				if !c.internal {
+					h.touch()
+				}
+			}
+		case r := <-h.presence:
+			r <- h.getPresence()
 		case m := <-h.broadcast:
-			for c := range h.connections {
+			h.send(m)
+		case code := <-h.quit:
+			// The queued messages go out before the close frames.
+			for flushed := false; !flushed; {
 				select {
-				case c.send <- m:
-					if h.verbose {
-						log.Printf("Sending message '%s' to a client.\n", m)
-					}
+				case m := <-h.broadcast:
+					h.send(m)
 				default:
-					delete(h.connections, c)
-					close(c.send)
-					go c.conn.Close()
+					flushed = true
 				}
 			}
-		case q := <-h.quit:
-			if q {
-				for c := range h.connections {
-					c.quit()
-				}
-				return
+			for c := range h.connections {
+				h.disconnect(c, code)
+			}
+			if h.upstream != nil {
+				h.upstream.stop()
 			}
+			h.closeCode = code
+			close(h.closed)
+			return
+		}
+	}
+}
+
+// Queues a message for the hub. Returns false if the hub is closed.
+func (h *wshub) post(m *hubMessage) bool {
+	select {
+	case h.broadcast <- m:
+		return true
+	case <-h.closed:
+		return false
+	}
+}
+
+// Makes the hub close the connections with a close code, unless it is closed already.
+func (h *wshub) close(code int) {
+	select {
+	case h.quit <- code:
+	case <-h.closed:
+	}
+}
+
+// Must be called from the hub's goroutine.
+func (h *wshub) send(m *hubMessage) {
+	h.state = m
+	if m.silent || m.expired() {
+		return
+	}
+	if m.report != nil {
+		atomic.AddInt64(&m.report.recipients, int64(h.getPresence().Listeners))
+	}
+	for c := range h.connections {
+		if h.verbose {
+			log.Printf("Sending message '%s' to a client.\n", m.data)
+		}
+		h.deliver(c, m)
+	}
+}
+
+// A subscriber of a hub without a websocket connection, like a webhook. The slow consumer policy of the hub can let
+// it go, but it keeps its place and subscribes again.
+type hubSubscriber struct {
+	hub     *wshub
+	id      string
+	verbose bool
+	// Guards the subscription.
+	lock    sync.Mutex
+	sub     *wsconnection
+	stopped bool
+}
+
+func newHubSubscriber(h *wshub, id string, verbose bool) *hubSubscriber {
+	return &hubSubscriber{hub: h, id: id, verbose: verbose}
+}
+
+// Registers the subscriber in the hub. Returns false if the subscriber is stopped or the hub is closed.
+func (s *hubSubscriber) subscribe() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped {
+		return false
+	}
+
+	s.sub = &wsconnection{
+		send:     make(chan *hubMessage, s.hub.sendBuffer),
+		hub:      s.hub,
+		id:       s.id,
+		verbose:  s.verbose,
+		internal: true,
+	}
+
+	select {
+	case s.hub.register <- s.sub:
+		return true
+	case <-s.hub.closed:
+		return false
+	}
+}
+
+// Subscribes again if the hub let the subscriber go because it was too slow. Must be called from the goroutine which
+// receives the messages, after their channel is closed.
+func (s *hubSubscriber) resubscribe() bool {
+	if s.sub.closeCode != closeTooSlow {
+		return false
+	}
+
+	if s.verbose {
+		log.Printf("Subscribing %s again after it was too slow.\n", s.id)
+	}
+
+	return s.subscribe()
+}
+
+// The messages of the current subscription. The channel is closed when the hub lets the subscriber go.
+func (s *hubSubscriber) messages() chan *hubMessage {
+	return s.sub.send
+}
+
+func (s *hubSubscriber) stop() {
+	s.lock.Lock()
+	s.stopped = true
+	sub := s.sub
+	s.lock.Unlock()
+
+	if sub != nil {
+		select {
+		case s.hub.unregister <- sub:
+		case <-s.hub.closed:
 		}
 	}
 }
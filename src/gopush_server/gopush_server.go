@@ -6,6 +6,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"syscall"
 
 	"log"
 
@@ -48,22 +49,40 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if config.RedisBackplane != "" && len(config.Peers) > 0 {
+		log.Fatalln("Redisbackplane and peers can't be used together.")
+	}
+
 	svc := gopush.NewService(config, gopush.NewMySQLBackend(config), gopush.NewStandardTemplateStoreInWorkingDir())
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	if config.RedisBackplane != "" {
+		channel := config.RedisChannel
+		if channel == "" {
+			channel = "gopush"
+		}
+		if err := svc.SetBackplane(gopush.NewRedisBackplane(config.RedisBackplane, channel)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The first signal stops the service gracefully, a second one exits right away.
+	stopped := make(chan bool)
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for sig := range c {
-			svc.Stop()
-			log.Printf("Received signal %d, shutting down\n", sig)
-			if *cpuProfile != "" { // Stop profiling
-				pprof.StopCPUProfile()
-			}
+		sig := <-c
+		log.Printf("Received signal %d, shutting down\n", sig)
+		go func() {
+			<-c
+			log.Println("Received another signal, exiting")
 			os.Exit(1)
-		}
+		}()
+		svc.Stop()
+		close(stopped)
 	}()
 
 	if err := svc.Start(); err != nil {
 		log.Fatal(err)
 	}
+	<-stopped
 }